@@ -35,7 +35,26 @@ ssh -i "$SSH_KEY" "$REMOTE_HOST" \
     "docker exec $CONTAINER_NAME mongorestore --drop --db $DATABASE_NAME \
     --nsExclude \"$DATABASE_NAME.surveys\" \
     --nsExclude \"$DATABASE_NAME.likes\" \
+    --nsExclude \"$DATABASE_NAME.like_counts\" \
     --nsExclude \"$DATABASE_NAME.users\" \
     --nsExclude \"$DATABASE_NAME.announcements\" \
+    --nsExclude \"$DATABASE_NAME.survey_questions\" \
+    --nsExclude \"$DATABASE_NAME.survey_tips\" \
+    --nsExclude \"$DATABASE_NAME.survey_summaries\" \
+    --nsExclude \"$DATABASE_NAME.settings\" \
+    --nsExclude \"$DATABASE_NAME.survey_reports\" \
+    --nsExclude \"$DATABASE_NAME.moderation_logs\" \
+    --nsExclude \"$DATABASE_NAME.survey_votes\" \
+    --nsExclude \"$DATABASE_NAME.waiting_reports\" \
+    --nsExclude \"$DATABASE_NAME.busyness_profiles\" \
+    --nsExclude \"$DATABASE_NAME.activity_events\" \
+    --nsExclude \"$DATABASE_NAME.favorite_lists\" \
+    --nsExclude \"$DATABASE_NAME.devices\" \
+    --nsExclude \"$DATABASE_NAME.transfer_codes\" \
     --dir $CONTAINER_LOAD_DIR"
 echo "$CONTAINER_LOAD_DIR is loaded"
+
+# Drop cached reference documents (holidays, info) in the backend
+ssh -i "$SSH_KEY" "$REMOTE_HOST" \
+    "curl -s -X POST -H 'X-Admin-Key: $SOTAM_ADMIN_KEY' http://localhost:8080/v1/cache/invalidate"
+echo "Backend cache is invalidated"
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Types of activity events
+const (
+	ActivityTypeLike   = "like"
+	ActivityTypeUnlike = "unlike"
+	ActivityTypeSurvey = "survey"
+)
+
+// Like, unlike and survey submission of a user, expired by the TTL index.
+// Likes are removed on unlike, so events are kept separately to know recent activity.
+type ActivityEventDocument struct {
+	Id         primitive.ObjectID `bson:"_id,omitempty"`
+	HospitalId string             `bson:"hospitalId"`
+	UserId     string             `bson:"userId"`
+	Type       string             `bson:"type"`
+	Timestamp  time.Time          `bson:"timestamp"`
+}
+
+type TrendingHospital struct {
+	ResponseHospital
+	TrendingScore     float64 `json:"trendingScore"`
+	RecentLikeCount   int     `json:"recentLikeCount"`   // Likes minus unlikes in the last 7 days
+	RecentSurveyCount int     `json:"recentSurveyCount"` // Surveys in the last 7 days
+}
+
+type TrendingResponse struct {
+	Hospitals []TrendingHospital `json:"hospitals"`
+}
+
+type trendingResult struct {
+	HospitalId        string  `bson:"_id"`
+	Score             float64 `bson:"score"`
+	RecentLikeCount   int     `bson:"recentLikeCount"`
+	RecentSurveyCount int     `bson:"recentSurveyCount"`
+}
+
+func ensureActivityEventCollectionIndex(collection *mongo.Collection) bool {
+	if collection.Name() != ActivityEventCollectionName {
+		log.Printf("Got wrong collection: %s", collection.Name())
+		return false
+	}
+
+	indexModels := []mongo.IndexModel{
+		// Aggregating recent events of hospitals
+		{
+			Keys: bson.D{
+				{Key: "hospitalId", Value: 1}, // 1 for ascending order
+				{Key: "timestamp", Value: -1}, // -1 for descending order
+			},
+		},
+		// Removing events of a user
+		{
+			Keys: bson.D{
+				{Key: "userId", Value: 1},
+			},
+		},
+		// Expire old events
+		{
+			Keys: bson.D{
+				{Key: "timestamp", Value: 1},
+			},
+			Options: options.Index().SetExpireAfterSeconds(int32(ActivityEventTtl.Seconds())),
+		},
+	}
+
+	_, err := collection.Indexes().CreateMany(context.Background(), indexModels)
+	if err != nil {
+		log.Println("Could not create index in activity event collection: " + err.Error())
+		return false
+	}
+	log.Println("Activity event collection index created successfully")
+	return true
+}
+
+func recordActivityEvent(collection *mongo.Collection, hospitalId string, userId string, eventType string) bool {
+	if collection.Name() != ActivityEventCollectionName {
+		log.Printf("Got wrong collection: %s", collection.Name())
+		return false
+	}
+
+	_, err := collection.InsertOne(context.Background(), ActivityEventDocument{
+		HospitalId: hospitalId,
+		UserId:     userId,
+		Type:       eventType,
+		Timestamp:  time.Now(),
+	})
+	if err != nil {
+		log.Println("Failed to record " + eventType + " event of " + hospitalId +
+			" for " + userId + ": " + err.Error())
+		return false
+	}
+	return true
+}
+
+// Weighted sum of events in the trending window, per hospital, in descending order of the score.
+// Events in the recent window weigh TrendingRecentWeight times more.
+func aggregateTrendingScores(collection *mongo.Collection, hospitalIds []string, limit int) ([]trendingResult, error) {
+	now := time.Now()
+	recent := now.Add(-TrendingRecentWindow)
+	isRecent := bson.D{{Key: "$gte", Value: bson.A{"$timestamp", recent}}}
+	typeWeight := bson.D{{Key: "$switch", Value: bson.D{
+		{Key: "branches", Value: bson.A{
+			bson.D{{Key: "case", Value: bson.D{{Key: "$eq", Value: bson.A{"$type", ActivityTypeLike}}}},
+				{Key: "then", Value: TrendingLikeWeight}},
+			bson.D{{Key: "case", Value: bson.D{{Key: "$eq", Value: bson.A{"$type", ActivityTypeUnlike}}}},
+				{Key: "then", Value: TrendingUnlikeWeight}},
+			bson.D{{Key: "case", Value: bson.D{{Key: "$eq", Value: bson.A{"$type", ActivityTypeSurvey}}}},
+				{Key: "then", Value: TrendingSurveyWeight}},
+		}},
+		{Key: "default", Value: 0},
+	}}}
+	recentCount := func(types bson.A) bson.D {
+		return bson.D{{Key: "$sum", Value: bson.D{{Key: "$cond", Value: bson.A{
+			bson.D{{Key: "$and", Value: bson.A{isRecent, bson.D{{Key: "$in", Value: bson.A{"$type", types}}}}}},
+			1, 0}}}}}
+	}
+
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.M{
+			"hospitalId": bson.M{"$in": hospitalIds},
+			"timestamp":  bson.M{"$gte": now.Add(-TrendingWindow)},
+		}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$hospitalId"},
+			{Key: "score", Value: bson.D{{Key: "$sum", Value: bson.D{{Key: "$multiply", Value: bson.A{
+				typeWeight,
+				bson.D{{Key: "$cond", Value: bson.A{isRecent, TrendingRecentWeight, 1}}},
+			}}}}}},
+			{Key: "recentLikes", Value: recentCount(bson.A{ActivityTypeLike})},
+			{Key: "recentUnlikes", Value: recentCount(bson.A{ActivityTypeUnlike})},
+			{Key: "recentSurveyCount", Value: recentCount(bson.A{ActivityTypeSurvey})},
+		}}},
+		bson.D{{Key: "$match", Value: bson.M{"score": bson.M{"$gt": 0}}}},
+		bson.D{{Key: "$addFields", Value: bson.D{
+			{Key: "recentLikeCount", Value: bson.D{{Key: "$subtract", Value: bson.A{"$recentLikes", "$recentUnlikes"}}}},
+		}}},
+		bson.D{{Key: "$sort", Value: bson.D{
+			{Key: "score", Value: -1}, // -1 for descending order
+			{Key: "_id", Value: 1},
+		}}},
+		bson.D{{Key: "$limit", Value: limit}},
+	}
+	cursor, err := collection.Aggregate(context.Background(), pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	var results []trendingResult
+	if err = cursor.All(context.Background(), &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Hospitals near the location, ranked by recent likes and surveys
+func handleGetTrendingHospitals(
+	activityCollection *mongo.Collection,
+	hospitalCollection *mongo.Collection,
+	holidayCollection *mongo.Collection,
+	surveyCollection *mongo.Collection,
+	likeCountCollection *mongo.Collection,
+	summaryCollection *mongo.Collection,
+	settingCollection *mongo.Collection,
+	waitingCollection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		begin := time.Now()
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if activityCollection.Name() != ActivityEventCollectionName ||
+			hospitalCollection.Name() != HospitalCollectionName ||
+			holidayCollection.Name() != HolidayCollectionName ||
+			surveyCollection.Name() != SurveyCollectionName ||
+			likeCountCollection.Name() != LikeCountCollectionName ||
+			summaryCollection.Name() != SurveySummaryCollectionName ||
+			settingCollection.Name() != SettingCollectionName ||
+			waitingCollection.Name() != WaitingReportCollectionName {
+			log.Println("Wrong collection is assigned")
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+
+		lat, err := strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
+		if err != nil {
+			log.Println("Error in TrendingHospitals: Bad lat param: " + err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		lng, err := strconv.ParseFloat(r.URL.Query().Get("lng"), 64)
+		if err != nil {
+			log.Println("Error in TrendingHospitals: Bad lng param: " + err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Pediatric hospitals within the radius
+		filter := bson.M{
+			"location": bson.M{"$geoWithin": bson.M{"$centerSphere": bson.A{
+				bson.A{lng, lat}, TrendingRadiusKm / EarthRadiusKm}}},
+			"dgidIdName": bson.M{"$regex": "소아청소년과"},
+		}
+		cursor, err := hospitalCollection.Find(context.Background(), filter)
+		if err != nil {
+			log.Println("Error in TrendingHospitals: collection.Find: " + err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer cursor.Close(context.Background())
+
+		var documents []DatabaseHospital
+		if err := cursor.All(context.Background(), &documents); err != nil {
+			log.Println("Error in TrendingHospitals: cursor.All: " + err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		hospitals := map[string]DatabaseHospital{}
+		hospitalIds := []string{}
+		for _, document := range documents {
+			hospitals[document.Hpid] = document
+			hospitalIds = append(hospitalIds, document.Hpid)
+		}
+
+		results, err := aggregateTrendingScores(activityCollection, hospitalIds, TrendingPageableCount)
+		if err != nil {
+			log.Println("Error in TrendingHospitals: aggregate: " + err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Create response hospitals in the order of the trending score
+		dayKey := getDayKey(holidayCollection)
+		scoreModel := getScoreModel(settingCollection)
+		response := TrendingResponse{Hospitals: []TrendingHospital{}}
+		for _, result := range results {
+			hospital := newResponseHospital(hospitals[result.HospitalId], dayKey, surveyCollection,
+				likeCountCollection, summaryCollection, waitingCollection, scoreModel)
+			response.Hospitals = append(response.Hospitals, TrendingHospital{
+				ResponseHospital:  *hospital,
+				TrendingScore:     result.Score,
+				RecentLikeCount:   result.RecentLikeCount,
+				RecentSurveyCount: result.RecentSurveyCount,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(response)
+
+		profilePerformance(ProfileKeyGetTrending, begin)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Set by -admin-name flag for the admin key commands
+var _commandAdminName = ""
+
+// Only the hash of the key is stored, the key is printed once when it is added
+type AdminKey struct {
+	Name      string    `bson:"name"` // Identity of the admin, e.g. moderator id of moderation logs
+	KeyHash   string    `bson:"keyHash"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+type AdminKeysDocument struct {
+	Id   string     `bson:"_id"`
+	Keys []AdminKey `bson:"keys"`
+}
+
+func hashAdminKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func getAdminKeys(collection *mongo.Collection) ([]AdminKey, error) {
+	if collection.Name() != SettingCollectionName {
+		return nil, fmt.Errorf("got wrong collection: %s", collection.Name())
+	}
+
+	value, err := getCachedValue(CacheKeyAdminKeys, func() (any, error) {
+		var document AdminKeysDocument
+		err := collection.FindOne(context.Background(), bson.M{"_id": SettingKeyAdminKeys}).Decode(&document)
+		if err == mongo.ErrNoDocuments {
+			return []AdminKey{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return document.Keys, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.([]AdminKey), nil
+}
+
+// Returns the name of the admin of the key
+func verifyAdminKey(collection *mongo.Collection, key string) (string, error) {
+	keys, err := getAdminKeys(collection)
+	if err != nil {
+		return "", err
+	}
+	hash := hashAdminKey(key)
+	for _, adminKey := range keys {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(adminKey.KeyHash)) == 1 {
+			return adminKey.Name, nil
+		}
+	}
+	return "", fmt.Errorf("unknown admin key")
+}
+
+// Require an admin key in X-Admin-Key header, and overwrite the field of the request
+// with the admin name so that the identity can not be spoofed. An empty field only checks the key.
+func withAdmin(settingCollection *mongo.Collection, field string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimSpace(r.Header.Get("X-Admin-Key"))
+		if key == "" {
+			http.Error(w, "Admin key is required", http.StatusUnauthorized)
+			return
+		}
+
+		name, err := verifyAdminKey(settingCollection, key)
+		if err != nil {
+			http.Error(w, "Invalid admin key", http.StatusForbidden)
+			log.Println("Rejected admin key: " + err.Error())
+			return
+		}
+		if field != "" {
+			if err = setRequestUserId(r, field, name); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				log.Println("Failed to set admin name of the request: " + err.Error())
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+// Add a key of the admin, replacing the existing one of the same name, and print it
+func addAdminKey(collection *mongo.Collection, name string) bool {
+	if collection.Name() != SettingCollectionName {
+		log.Printf("Got wrong collection: %s", collection.Name())
+		return false
+	}
+	if name == "" {
+		log.Println("Admin name is required, set it with -admin-name")
+		return false
+	}
+
+	secret := make([]byte, AdminKeyBytes)
+	if _, err := rand.Read(secret); err != nil {
+		log.Println("Failed to create admin key: " + err.Error())
+		return false
+	}
+	key := hex.EncodeToString(secret)
+
+	if !removeAdminKey(collection, name) {
+		return false
+	}
+	_, err := collection.UpdateOne(context.Background(), bson.M{"_id": SettingKeyAdminKeys},
+		bson.M{"$push": bson.M{"keys": AdminKey{Name: name, KeyHash: hashAdminKey(key), CreatedAt: time.Now()}}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		log.Println("Failed to save admin key: " + err.Error())
+		return false
+	}
+	invalidateCache(CacheKeyAdminKeys)
+	log.Printf("Added admin key of %s, keep it as it can not be shown again: %s", name, key)
+	return true
+}
+
+func removeAdminKey(collection *mongo.Collection, name string) bool {
+	if collection.Name() != SettingCollectionName {
+		log.Printf("Got wrong collection: %s", collection.Name())
+		return false
+	}
+
+	_, err := collection.UpdateOne(context.Background(), bson.M{"_id": SettingKeyAdminKeys},
+		bson.M{"$pull": bson.M{"keys": bson.M{"name": name}}})
+	if err != nil {
+		log.Println("Failed to remove admin key of " + name + ": " + err.Error())
+		return false
+	}
+	invalidateCache(CacheKeyAdminKeys)
+	return true
+}
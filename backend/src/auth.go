@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Set by -auth-mode flag on start
+var _authMode = AuthModeLegacy
+
+// Context key of the user id verified by a device token
+type deviceUserContextKey struct{}
+
+// HMAC key to sign device tokens. Tokens signed by retired keys are valid until they expire.
+type AuthKey struct {
+	Id        string    `bson:"id"`
+	Secret    []byte    `bson:"secret"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+type AuthKeysDocument struct {
+	Id   string    `bson:"_id"`
+	Keys []AuthKey `bson:"keys"` // Oldest first, the last one signs new tokens
+}
+
+// Registered device, whose id is the user id of the device
+type DeviceDocument struct {
+	UserId       string `bson:"_id"`
+	Legacy       bool   `bson:"legacy"` // Claimed an id generated by the app
+	RegisteredAt string `bson:"registeredAt"`
+	RefreshedAt  string `bson:"refreshedAt"`
+}
+
+type DeviceRegisterRequest struct {
+	LegacyUserId string `json:"legacyUserId"` // Id generated by the app before tokens, to keep the data
+}
+
+type DeviceRegisterResponse struct {
+	UserId    string `json:"userId"`
+	Token     string `json:"token"`
+	ExpiresAt string `json:"expiresAt"` // Register again with the token to refresh it before expiry
+}
+
+type deviceTokenHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyId     string `json:"kid"`
+}
+
+type deviceTokenClaims struct {
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+func newRandomId() (string, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+func getAuthKeys(collection *mongo.Collection) ([]AuthKey, error) {
+	if collection.Name() != SettingCollectionName {
+		return nil, fmt.Errorf("got wrong collection: %s", collection.Name())
+	}
+
+	value, err := getCachedValue(CacheKeyAuthKeys, func() (any, error) {
+		var document AuthKeysDocument
+		err := collection.FindOne(context.Background(), bson.M{"_id": SettingKeyAuthKeys}).Decode(&document)
+		if err != nil {
+			return nil, err
+		}
+		return document.Keys, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.([]AuthKey), nil
+}
+
+// Add a new signing key if the current one is old, and remove keys
+// that can not have signed unexpired tokens
+func rotateAuthKeys(collection *mongo.Collection) bool {
+	if collection.Name() != SettingCollectionName {
+		log.Printf("Got wrong collection: %s", collection.Name())
+		return false
+	}
+
+	document := AuthKeysDocument{Id: SettingKeyAuthKeys}
+	err := collection.FindOne(context.Background(), bson.M{"_id": SettingKeyAuthKeys}).Decode(&document)
+	if err != nil && err != mongo.ErrNoDocuments {
+		log.Println("Failed to find auth keys: " + err.Error())
+		return false
+	}
+
+	now := time.Now()
+	keys := []AuthKey{}
+	for _, key := range document.Keys {
+		if now.Sub(key.CreatedAt) < AuthKeyRotationInterval+DeviceTokenTtl {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 || now.Sub(keys[len(keys)-1].CreatedAt) >= AuthKeyRotationInterval {
+		id, err := newRandomId()
+		if err != nil {
+			log.Println("Failed to create auth key id: " + err.Error())
+			return false
+		}
+		secret := make([]byte, AuthKeyBytes)
+		if _, err := rand.Read(secret); err != nil {
+			log.Println("Failed to create auth key: " + err.Error())
+			return false
+		}
+		keys = append(keys, AuthKey{Id: id, Secret: secret, CreatedAt: now})
+		log.Println("Created a new auth key " + id)
+	} else if len(keys) == len(document.Keys) {
+		return true
+	}
+
+	document.Keys = keys
+	_, err = collection.ReplaceOne(context.Background(), bson.M{"_id": SettingKeyAuthKeys},
+		document, options.Replace().SetUpsert(true))
+	if err != nil {
+		log.Println("Failed to save auth keys: " + err.Error())
+		return false
+	}
+	invalidateCache(CacheKeyAuthKeys)
+	return true
+}
+
+func startAuthKeyRotator(collection *mongo.Collection) {
+	go func() {
+		for range time.Tick(AuthKeyRotationCheckInterval) {
+			rotateAuthKeys(collection)
+		}
+	}()
+}
+
+func signDeviceToken(key AuthKey, input string) string {
+	mac := hmac.New(sha256.New, key.Secret)
+	mac.Write([]byte(input))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// JWT signed with HS256 by the latest key
+func newDeviceToken(collection *mongo.Collection, userId string) (string, time.Time, error) {
+	keys, err := getAuthKeys(collection)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if len(keys) == 0 {
+		return "", time.Time{}, fmt.Errorf("no auth key")
+	}
+	key := keys[len(keys)-1]
+
+	now := time.Now()
+	expiresAt := now.Add(DeviceTokenTtl)
+	header, err := json.Marshal(deviceTokenHeader{Algorithm: "HS256", Type: "JWT", KeyId: key.Id})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	claims, err := json.Marshal(deviceTokenClaims{
+		Subject:   userId,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return input + "." + signDeviceToken(key, input), expiresAt, nil
+}
+
+// Returns the user id of the token
+func verifyDeviceToken(collection *mongo.Collection, token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed token")
+	}
+
+	var header deviceTokenHeader
+	headerJson, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerJson, &header) != nil || header.Algorithm != "HS256" {
+		return "", fmt.Errorf("malformed token header")
+	}
+
+	keys, err := getAuthKeys(collection)
+	if err != nil {
+		return "", err
+	}
+	var key *AuthKey
+	for i := range keys {
+		if keys[i].Id == header.KeyId {
+			key = &keys[i]
+		}
+	}
+	if key == nil {
+		return "", fmt.Errorf("unknown key")
+	}
+	expected := signDeviceToken(*key, parts[0]+"."+parts[1])
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return "", fmt.Errorf("invalid signature")
+	}
+
+	var claims deviceTokenClaims
+	claimsJson, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(claimsJson, &claims) != nil || claims.Subject == "" {
+		return "", fmt.Errorf("malformed token claims")
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return "", fmt.Errorf("expired token")
+	}
+	return claims.Subject, nil
+}
+
+func getBearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+}
+
+// Overwrite the user id field of the query and the JSON body with the given user id,
+// so that handlers can keep reading the user id from the request
+func setRequestUserId(r *http.Request, field string, userId string) error {
+	query := r.URL.Query()
+	query.Set(field, userId)
+	r.URL.RawQuery = query.Encode()
+
+	if r.Body == nil || (r.Method != http.MethodPost && r.Method != http.MethodPut) {
+		return nil
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body.Close()
+
+	// Keep the body as is if it's not an object, the handler rejects it
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) == nil && fields != nil {
+		value, _ := json.Marshal(userId)
+		fields[field] = value
+		body, err = json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return nil
+}
+
+// Read the user id field of the query, or of the JSON body which is kept for the handler
+func getRequestUserId(r *http.Request, field string) (string, error) {
+	if userId := r.URL.Query().Get(field); userId != "" {
+		return userId, nil
+	}
+	if r.Body == nil || (r.Method != http.MethodPost && r.Method != http.MethodPut) {
+		return "", nil
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return "", err
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var fields map[string]any
+	if json.Unmarshal(body, &fields) != nil {
+		return "", nil
+	}
+	userId, _ := fields[field].(string)
+	return userId, nil
+}
+
+// Derive the user from the device token, and overwrite the user id field of the request.
+// Requests without a token are passed as is in the legacy mode.
+func withDeviceUser(settingCollection *mongo.Collection, field string, handler http.HandlerFunc) http.HandlerFunc {
+	return withDeviceToken(settingCollection, field, false, handler)
+}
+
+// Same as withDeviceUser for sensitive endpoints, but requires a token for registered users
+// in the legacy mode. Legacy ids with data can not be claimed, so their requests without
+// tokens are accepted until the strict mode, while registered ids are not taken over.
+func withRequiredDeviceUser(settingCollection *mongo.Collection, deviceCollection *mongo.Collection,
+	field string, handler http.HandlerFunc) http.HandlerFunc {
+	withToken := withDeviceToken(settingCollection, field, true, handler)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _authMode != AuthModeLegacy || getBearerToken(r) != "" {
+			withToken(w, r)
+			return
+		}
+
+		if deviceCollection.Name() != DeviceCollectionName {
+			log.Printf("Got wrong collection: %s", deviceCollection.Name())
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+		userId, err := getRequestUserId(r, field)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Println("Failed to read user id of the request: " + err.Error())
+			return
+		}
+		if userId != "" {
+			registered, err := deviceCollection.CountDocuments(context.Background(),
+				bson.M{"_id": userId}, options.Count().SetLimit(1))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				log.Println("Failed to find device of " + userId + ": " + err.Error())
+				return
+			}
+			if registered > 0 {
+				http.Error(w, "Device token is required for registered users", http.StatusUnauthorized)
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+func withDeviceToken(settingCollection *mongo.Collection, field string, required bool,
+	handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := getBearerToken(r)
+		if token == "" {
+			if _authMode == AuthModeLegacy && !required {
+				handler(w, r)
+				return
+			}
+			http.Error(w, "Device token is required", http.StatusUnauthorized)
+			return
+		}
+
+		userId, err := verifyDeviceToken(settingCollection, token)
+		if err != nil {
+			http.Error(w, "Invalid device token", http.StatusUnauthorized)
+			log.Println("Rejected device token: " + err.Error())
+			return
+		}
+		if err = setRequestUserId(r, field, userId); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Println("Failed to set user id of the request: " + err.Error())
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), deviceUserContextKey{}, userId)))
+	}
+}
+
+// User id verified by the device token of the request, empty for requests without tokens
+func getDeviceUserId(r *http.Request) string {
+	userId, _ := r.Context().Value(deviceUserContextKey{}).(string)
+	return userId
+}
+
+// Issue a device token. A valid token refreshes itself, a legacy user id without likes and surveys
+// is claimed once in the legacy mode, and a new user id is created otherwise.
+func handlePostDeviceRegister(deviceCollection *mongo.Collection,
+	settingCollection *mongo.Collection,
+	userCollection *mongo.Collection,
+	likeCollection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if deviceCollection.Name() != DeviceCollectionName ||
+			settingCollection.Name() != SettingCollectionName ||
+			userCollection.Name() != UserCollectionName ||
+			likeCollection.Name() != LikeCollectionName {
+			log.Println("Wrong collection is assigned")
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+
+		var request DeviceRegisterRequest
+		if r.ContentLength != 0 {
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				log.Println("Failed to decode device register request: " + err.Error())
+				return
+			}
+		}
+
+		now := time.Now().Format(TimestampFormat)
+		var userId string
+		if token := getBearerToken(r); token != "" {
+			// Refresh
+			var err error
+			userId, err = verifyDeviceToken(settingCollection, token)
+			if err != nil {
+				http.Error(w, "Invalid device token", http.StatusUnauthorized)
+				log.Println("Rejected device token: " + err.Error())
+				return
+			}
+			_, err = deviceCollection.UpdateOne(context.Background(), bson.M{"_id": userId},
+				bson.M{"$set": bson.M{"refreshedAt": now}})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				log.Println("Failed to refresh device " + userId + ": " + err.Error())
+				return
+			}
+		} else {
+			device := DeviceDocument{RegisteredAt: now, RefreshedAt: now}
+			if request.LegacyUserId != "" {
+				if _authMode != AuthModeLegacy {
+					http.Error(w, "Legacy user ids are not accepted", http.StatusForbidden)
+					return
+				}
+
+				// There is no proof of ownership of a legacy user id,
+				// so ids with data can not be claimed to not take over the data of others
+				var user UserDocument
+				err := userCollection.FindOne(context.Background(),
+					bson.M{"_id": request.LegacyUserId}).Decode(&user)
+				if err != nil && err != mongo.ErrNoDocuments {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					log.Println("Failed to find user " + request.LegacyUserId + ": " + err.Error())
+					return
+				}
+				likes, err := likeCollection.CountDocuments(context.Background(),
+					bson.M{"userId": request.LegacyUserId}, options.Count().SetLimit(1))
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					log.Println("Failed to count likes of " + request.LegacyUserId + ": " + err.Error())
+					return
+				}
+				if likes > 0 || len(user.Surveys) > 0 {
+					http.Error(w, "User id with likes or surveys can not be claimed", http.StatusForbidden)
+					return
+				}
+				device.UserId = request.LegacyUserId
+				device.Legacy = true
+			} else {
+				var err error
+				device.UserId, err = newRandomId()
+				if err != nil {
+					http.Error(w, "Error while creating user id", http.StatusInternalServerError)
+					log.Println("Failed to create user id: " + err.Error())
+					return
+				}
+			}
+
+			// A legacy user id can be claimed only by the first device
+			_, err := deviceCollection.InsertOne(context.Background(), device)
+			if mongo.IsDuplicateKeyError(err) {
+				http.Error(w, "User id is already registered", http.StatusConflict)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				log.Println("Failed to register device " + device.UserId + ": " + err.Error())
+				return
+			}
+			userId = device.UserId
+		}
+
+		token, expiresAt, err := newDeviceToken(settingCollection, userId)
+		if err != nil {
+			http.Error(w, "Error while creating device token", http.StatusInternalServerError)
+			log.Println("Failed to create device token of " + userId + ": " + err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(DeviceRegisterResponse{
+			UserId:    userId,
+			Token:     token,
+			ExpiresAt: expiresAt.Format(TimestampFormat),
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// Comparison of a selection question of a hospital with other hospitals
+type SurveyBenchmark struct {
+	Region      string    `json:"region"`      // Empty if compared nationwide
+	BaseCount   int       `json:"baseCount"`   // Answers of the baseline
+	BaseRates   []float64 `json:"baseRates"`   // Baseline option rates, same order as options
+	Rates       []float64 `json:"rates"`       // Option rates of the hospital
+	Deltas      []float64 `json:"deltas"`      // Rates - baseRates
+	Percentile  *float64  `json:"percentile"`  // 0 ~ 100 among hospitals of the baseline, null if the question is not scored
+	NationRates []float64 `json:"nationRates"` // Nationwide option rates
+}
+
+type surveyBaseline struct {
+	counts map[string]map[string]int // Question -> option -> count
+	means  map[string][]float64      // Question -> sorted mean values of hospitals
+}
+
+type surveyBenchmarkData struct {
+	mutex    sync.RWMutex
+	regions  map[string]surveyBaseline
+	national surveyBaseline
+	model    ScoreModel // Model used for the means
+}
+
+var _surveyBenchmark = surveyBenchmarkData{
+	mutex:    sync.RWMutex{},
+	regions:  map[string]surveyBaseline{},
+	national: newSurveyBaseline(),
+	model:    DefaultScoreModel,
+}
+
+func newSurveyBaseline() surveyBaseline {
+	return surveyBaseline{
+		counts: map[string]map[string]int{},
+		means:  map[string][]float64{},
+	}
+}
+
+func (baseline surveyBaseline) add(model ScoreModel, counts map[string]map[string]int) {
+	for question, options := range counts {
+		if baseline.counts[question] == nil {
+			baseline.counts[question] = map[string]int{}
+		}
+		for option, count := range options {
+			baseline.counts[question][option] += count
+		}
+		if mean, ok := model.getQuestionMean(question, options); ok {
+			baseline.means[question] = append(baseline.means[question], mean)
+		}
+	}
+}
+
+func (baseline surveyBaseline) questionCount(question string) int {
+	total := 0
+	for _, count := range baseline.counts[question] {
+		total += count
+	}
+	return total
+}
+
+// Mean value of the answers of a scored question
+func (model ScoreModel) getQuestionMean(question string, counts map[string]int) (float64, bool) {
+	values, ok := model.Values[question]
+	if !ok {
+		return 0, false
+	}
+	sum, total := 0.0, 0
+	for option, value := range values {
+		sum += value * float64(counts[option])
+		total += counts[option]
+	}
+	if total == 0 {
+		return 0, false
+	}
+	return sum / float64(total), true
+}
+
+func getOptionRates(options []string, counts map[string]int) []float64 {
+	total := 0
+	for _, option := range options {
+		total += counts[option]
+	}
+	rates := []float64{}
+	for _, option := range options {
+		rate := 0.0
+		if total > 0 {
+			rate = float64(counts[option]) / float64(total)
+		}
+		rates = append(rates, rate)
+	}
+	return rates
+}
+
+// Percentage of values below the value, counting the same values as half
+func getPercentile(sortedValues []float64, value float64) float64 {
+	below := sort.SearchFloat64s(sortedValues, value)
+	above := sort.Search(len(sortedValues), func(i int) bool { return sortedValues[i] > value })
+	return 100 * (float64(below) + float64(above-below)/2) / float64(len(sortedValues))
+}
+
+// Recompute regional and national baselines from the summaries of all hospitals
+func refreshSurveyBenchmarks(model ScoreModel,
+	summaries []SurveySummaryDocument, hospitalRegions map[string]string) {
+	national := newSurveyBaseline()
+	regions := map[string]surveyBaseline{}
+	for _, summary := range summaries {
+		national.add(model, summary.Counts)
+		region := hospitalRegions[summary.HospitalId]
+		if region == "" {
+			continue
+		}
+		if _, ok := regions[region]; !ok {
+			regions[region] = newSurveyBaseline()
+		}
+		regions[region].add(model, summary.Counts)
+	}
+	for _, means := range national.means {
+		sort.Float64s(means)
+	}
+	for _, baseline := range regions {
+		for _, means := range baseline.means {
+			sort.Float64s(means)
+		}
+	}
+
+	_surveyBenchmark.mutex.Lock()
+	_surveyBenchmark.regions = regions
+	_surveyBenchmark.national = national
+	_surveyBenchmark.model = model
+	_surveyBenchmark.mutex.Unlock()
+}
+
+// Compare the question of the hospital with the region,
+// or nationwide if the region doesn't have enough answers
+func getSurveyBenchmark(document SurveySummaryDocument,
+	question string, options []string) *SurveyBenchmark {
+	_surveyBenchmark.mutex.RLock()
+	defer _surveyBenchmark.mutex.RUnlock()
+
+	model := _surveyBenchmark.model
+	national := _surveyBenchmark.national
+	if national.questionCount(question) == 0 {
+		return nil
+	}
+
+	region := document.Region
+	baseline, ok := _surveyBenchmark.regions[region]
+	if !ok || baseline.questionCount(question) < model.MinRegionalCount {
+		region = ""
+		baseline = national
+	}
+
+	benchmark := SurveyBenchmark{
+		Region:      region,
+		BaseCount:   baseline.questionCount(question),
+		BaseRates:   getOptionRates(options, baseline.counts[question]),
+		Rates:       getOptionRates(options, document.Counts[question]),
+		Deltas:      []float64{},
+		Percentile:  nil,
+		NationRates: getOptionRates(options, national.counts[question]),
+	}
+	for i := range options {
+		benchmark.Deltas = append(benchmark.Deltas, benchmark.Rates[i]-benchmark.BaseRates[i])
+	}
+	if mean, ok := model.getQuestionMean(question, document.Counts[question]); ok && len(baseline.means[question]) > 0 {
+		percentile := getPercentile(baseline.means[question], mean)
+		benchmark.Percentile = &percentile
+	}
+	return &benchmark
+}
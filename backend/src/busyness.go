@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Expected busyness of a hospital by weekday and hour, refreshed by the background job
+type BusynessProfileDocument struct {
+	HospitalId  string                `bson:"_id" json:"hospitalId"`
+	Days        map[string][]*float64 `bson:"days" json:"days"` // Weekday 1 (monday) ~ 7 -> 24 hours of 0 ~ 1, null if unknown
+	ReportCount int                   `bson:"reportCount" json:"reportCount"`
+	SurveyCount int                   `bson:"surveyCount" json:"surveyCount"`
+	LastUpdate  string                `bson:"lastUpdate" json:"lastUpdate"`
+}
+
+type busynessSlot struct {
+	waitingSum   float64
+	waitingCount int
+	surveyCount  int
+}
+
+// Hospital -> weekday (1 ~ 7) -> hour
+type busynessSlots map[string]*[8][24]busynessSlot
+
+func (slots busynessSlots) get(hospitalId string, weekday int, hour int) *busynessSlot {
+	days, ok := slots[hospitalId]
+	if !ok {
+		days = &[8][24]busynessSlot{}
+		slots[hospitalId] = days
+	}
+	return &days[weekday][hour]
+}
+
+// Group stage key of weekday (1: monday ~ 7: sunday) and hour in the local timezone
+func getWeekdayHourGroupKey(field string) bson.D {
+	dayOfWeek := bson.D{{Key: "$dayOfWeek", Value: bson.D{
+		{Key: "date", Value: field},
+		{Key: "timezone", Value: time.Local.String()},
+	}}}
+	return bson.D{
+		{Key: "hospitalId", Value: "$hospitalId"},
+		// Mongo weekday starts from sunday (1)
+		{Key: "weekday", Value: bson.D{{Key: "$add", Value: bson.A{
+			bson.D{{Key: "$mod", Value: bson.A{bson.D{{Key: "$add", Value: bson.A{dayOfWeek, 5}}}, 7}}}, 1}}}},
+		{Key: "hour", Value: bson.D{{Key: "$hour", Value: bson.D{
+			{Key: "date", Value: field},
+			{Key: "timezone", Value: time.Local.String()},
+		}}}},
+	}
+}
+
+type busynessGroupResult struct {
+	Id struct {
+		HospitalId string `bson:"hospitalId"`
+		Weekday    int    `bson:"weekday"`
+		Hour       int    `bson:"hour"`
+	} `bson:"_id"`
+	Count   int     `bson:"count"`
+	Minutes float64 `bson:"minutes"`
+}
+
+func aggregateBusynessSlots(waitingCollection *mongo.Collection,
+	surveyCollection *mongo.Collection) (busynessSlots, error) {
+	slots := busynessSlots{}
+
+	// Waiting reports, with representative minutes of buckets
+	branches := bson.A{}
+	for _, bucket := range WaitingBuckets {
+		branches = append(branches, bson.D{
+			{Key: "case", Value: bson.D{{Key: "$eq", Value: bson.A{"$minutes", bucket.Key}}}},
+			{Key: "then", Value: bucket.Minutes},
+		})
+	}
+	waitingPipeline := mongo.Pipeline{
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: getWeekdayHourGroupKey("$timestamp")},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "minutes", Value: bson.D{{Key: "$sum", Value: bson.D{{Key: "$switch", Value: bson.D{
+				{Key: "branches", Value: branches},
+				{Key: "default", Value: 0},
+			}}}}}},
+		}}},
+	}
+	err := forEachBusynessGroup(waitingCollection, waitingPipeline, func(result busynessGroupResult) {
+		slot := slots.get(result.Id.HospitalId, result.Id.Weekday, result.Id.Hour)
+		slot.waitingSum += result.Minutes
+		slot.waitingCount += result.Count
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Survey submissions as visits, as most surveys are submitted right after a visit
+	surveyPipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.M{
+			"timestamp": bson.M{"$type": "date"},
+			"hidden":    bson.M{"$ne": true},
+		}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: getWeekdayHourGroupKey("$timestamp")},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+	}
+	err = forEachBusynessGroup(surveyCollection, surveyPipeline, func(result busynessGroupResult) {
+		slots.get(result.Id.HospitalId, result.Id.Weekday, result.Id.Hour).surveyCount += result.Count
+	})
+	if err != nil {
+		return nil, err
+	}
+	return slots, nil
+}
+
+func forEachBusynessGroup(collection *mongo.Collection, pipeline mongo.Pipeline,
+	handle func(result busynessGroupResult)) error {
+	cursor, err := collection.Aggregate(context.Background(), pipeline)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(context.Background()) {
+		var result busynessGroupResult
+		err = cursor.Decode(&result)
+		if err != nil {
+			log.Println("Busyness cursor decode error: " + err.Error())
+			continue
+		}
+		if result.Id.HospitalId == "" || result.Id.Weekday < 1 || result.Id.Weekday > 7 ||
+			result.Id.Hour < 0 || result.Id.Hour > 23 {
+			continue
+		}
+		handle(result)
+	}
+	return nil
+}
+
+// Busyness is the average waiting minutes relative to the longest bucket,
+// mixed with survey counts relative to the busiest hour of the hospital
+func newBusynessProfileDocument(hospitalId string, days *[8][24]busynessSlot) BusynessProfileDocument {
+	document := BusynessProfileDocument{
+		HospitalId: hospitalId,
+		Days:       map[string][]*float64{},
+	}
+
+	maxWaiting := WaitingBuckets[len(WaitingBuckets)-1].Minutes
+	maxSurveyCount := 0
+	for weekday := 1; weekday <= 7; weekday++ {
+		for _, slot := range days[weekday] {
+			maxSurveyCount = max(maxSurveyCount, slot.surveyCount)
+			document.ReportCount += slot.waitingCount
+			document.SurveyCount += slot.surveyCount
+		}
+	}
+
+	for weekday := 1; weekday <= 7; weekday++ {
+		hours := make([]*float64, 24)
+		for hour, slot := range days[weekday] {
+			if slot.waitingCount == 0 && slot.surveyCount == 0 {
+				continue
+			}
+			surveyLevel := float64(slot.surveyCount) / float64(max(maxSurveyCount, 1))
+			busyness := surveyLevel
+			if slot.waitingCount > 0 {
+				waitingLevel := min(slot.waitingSum/float64(slot.waitingCount)/maxWaiting, 1)
+				busyness = BusynessWaitingWeight*waitingLevel + (1-BusynessWaitingWeight)*surveyLevel
+			}
+			hours[hour] = &busyness
+		}
+		document.Days[strconv.Itoa(weekday)] = hours
+	}
+	return document
+}
+
+func refreshBusynessProfiles(waitingCollection *mongo.Collection,
+	surveyCollection *mongo.Collection,
+	busynessCollection *mongo.Collection) (int, error) {
+	if waitingCollection.Name() != WaitingReportCollectionName ||
+		surveyCollection.Name() != SurveyCollectionName ||
+		busynessCollection.Name() != BusynessProfileCollectionName {
+		return 0, fmt.Errorf("wrong collection is assigned")
+	}
+
+	slots, err := aggregateBusynessSlots(waitingCollection, surveyCollection)
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := time.Now().Format(TimestampFormat)
+	hospitalIds := []string{}
+	models := []mongo.WriteModel{}
+	for hospitalId, days := range slots {
+		hospitalIds = append(hospitalIds, hospitalId)
+		document := newBusynessProfileDocument(hospitalId, days)
+		document.LastUpdate = timestamp
+		models = append(models, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"_id": hospitalId}).
+			SetReplacement(document).
+			SetUpsert(true))
+	}
+	if len(models) > 0 {
+		_, err = busynessCollection.BulkWrite(context.Background(), models)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Remove profiles of hospitals without data, e.g. whose reports are expired
+	_, err = busynessCollection.DeleteMany(context.Background(),
+		bson.M{"_id": bson.M{"$nin": hospitalIds}})
+	if err != nil {
+		return 0, err
+	}
+	return len(slots), nil
+}
+
+func startBusynessRefresher(waitingCollection *mongo.Collection,
+	surveyCollection *mongo.Collection,
+	busynessCollection *mongo.Collection) {
+	refresh := func() {
+		count, err := refreshBusynessProfiles(waitingCollection, surveyCollection, busynessCollection)
+		if err != nil {
+			log.Println("Failed to refresh busyness profiles: " + err.Error())
+			return
+		}
+		log.Printf("Refreshed busyness profiles of %d hospitals", count)
+	}
+
+	// Aggregating all reports and surveys takes a while, so don't block the server start
+	go func() {
+		refresh()
+		for range time.Tick(BusynessRefreshInterval) {
+			refresh()
+		}
+	}()
+}
+
+func handleGetBusynessProfile(collection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if collection.Name() != BusynessProfileCollectionName {
+			log.Printf("Got wrong collection: %s", collection.Name())
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+
+		hospitalId := r.URL.Query().Get("hospitalId")
+		if hospitalId == "" {
+			http.Error(w, "hospitalId is empty", http.StatusBadRequest)
+			return
+		}
+
+		var document BusynessProfileDocument
+		err := collection.FindOne(context.Background(), bson.M{"_id": hospitalId}).Decode(&document)
+
+		// There is a chance that the document doesn't exist
+		if err == mongo.ErrNoDocuments {
+			document = newBusynessProfileDocument(hospitalId, &[8][24]busynessSlot{})
+		} else if err != nil {
+			log.Println("Error while finding busyness profile: " + err.Error())
+			http.Error(w, "Error while finding busyness profile", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(document)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type cacheData struct {
+	mutex     sync.Mutex
+	ttl       time.Duration
+	value     any
+	expiresAt time.Time
+	hitCount  int
+	missCount int
+}
+
+type CacheInvalidateResponse struct {
+	Invalidated []string `json:"invalidated"`
+}
+
+var _cacheMap = make(map[string]*cacheData)
+
+func startCache(keys []string, ttl time.Duration) {
+	for _, key := range keys {
+		_cacheMap[key] = &cacheData{
+			mutex: sync.Mutex{},
+			ttl:   ttl,
+		}
+	}
+}
+
+// Return the cached value of the key, or load and cache it if it is missing or expired.
+// Errors from load are not cached, so the next call tries to load again.
+func getCachedValue(key string, load func() (any, error)) (any, error) {
+	cache, ok := _cacheMap[key]
+	if !ok {
+		log.Println("Wrong cache key: ", key)
+		return load()
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if cache.value != nil && time.Now().Before(cache.expiresAt) {
+		cache.hitCount++
+		return cache.value, nil
+	}
+	cache.missCount++
+
+	value, err := load()
+	if err != nil {
+		return nil, err
+	}
+	cache.value = value
+	cache.expiresAt = time.Now().Add(cache.ttl)
+	return value, nil
+}
+
+func invalidateCache(key string) bool {
+	cache, ok := _cacheMap[key]
+	if !ok {
+		log.Println("Wrong cache key: ", key)
+		return false
+	}
+
+	cache.mutex.Lock()
+	cache.value = nil
+	cache.expiresAt = time.Time{}
+	cache.mutex.Unlock()
+	return true
+}
+
+func invalidateAllCaches() []string {
+	keys := []string{}
+	for key := range _cacheMap {
+		if invalidateCache(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Called from the profiler summary routine
+func logCacheSummary() {
+	for key, cache := range _cacheMap {
+		cache.mutex.Lock()
+
+		// Print result
+		var hitRate float64
+		if total := cache.hitCount + cache.missCount; total > 0 {
+			hitRate = float64(cache.hitCount) / float64(total)
+		}
+		log.Printf("[Cache summary] key: %s, hit: %d, miss: %d, hit rate: %.3f\n",
+			key, cache.hitCount, cache.missCount, hitRate)
+
+		// Reset data
+		cache.hitCount = 0
+		cache.missCount = 0
+
+		cache.mutex.Unlock()
+	}
+}
+
+func handlePostCacheInvalidate() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Invalidate all caches if key is not given
+		response := CacheInvalidateResponse{
+			Invalidated: []string{},
+		}
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			response.Invalidated = invalidateAllCaches()
+		} else if invalidateCache(key) {
+			response.Invalidated = append(response.Invalidated, key)
+		} else {
+			http.Error(w, fmt.Sprintf("Unknown cache key: %s", key), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Invalidated caches: %v", response.Invalidated)
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(response)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"log"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Maintenance commands, run instead of the server with -command flag
+// e.g. docker exec backend /run_hospital_api_server -command verify-survey-summaries
+var CommandNames = []string{
+	CommandRebuildSurveySummaries,
+	CommandVerifySurveySummaries,
+	CommandMigrateLikes,
+	CommandReconcile,
+	CommandAddQuestionConditions,
+	CommandExcludeInapplicable,
+	CommandAddAdminKey,
+	CommandRemoveAdminKey,
+}
+
+// Returns true if the command succeeded
+func runCommand(command string, db *mongo.Database) bool {
+	surveyCollection := db.Collection(SurveyCollectionName)
+	surveySummaryCollection := db.Collection(SurveySummaryCollectionName)
+	likeCollection := db.Collection(LikeCollectionName)
+	likeCountCollection := db.Collection(LikeCountCollectionName)
+	settingCollection := db.Collection(SettingCollectionName)
+
+	switch command {
+	case CommandRebuildSurveySummaries:
+		count, err := rebuildSurveySummaries(surveyCollection, surveySummaryCollection)
+		if err != nil {
+			log.Println("Failed to rebuild survey summaries: " + err.Error())
+			return false
+		}
+		log.Printf("Rebuilt survey summaries of %d hospitals", count)
+
+		// Scores are kept on rebuild, refresh them with the new counts
+		err = refreshScores(db.Collection(HospitalCollectionName), surveySummaryCollection, settingCollection)
+		if err != nil {
+			log.Println("Failed to refresh scores: " + err.Error())
+			return false
+		}
+
+		// Check the result
+		return runCommand(CommandVerifySurveySummaries, db)
+
+	case CommandVerifySurveySummaries:
+		mismatches, err := verifySurveySummaries(surveyCollection, surveySummaryCollection)
+		if err != nil {
+			log.Println("Failed to verify survey summaries: " + err.Error())
+			return false
+		}
+		if len(mismatches) > 0 {
+			log.Printf("Survey summaries of %d hospitals are inconsistent: %v", len(mismatches), mismatches)
+			return false
+		}
+		log.Println("Survey summaries are consistent")
+		return true
+
+	case CommandMigrateLikes:
+		count, err := migrateLikes(likeCollection)
+		if err != nil {
+			log.Println("Failed to migrate likes: " + err.Error())
+			return false
+		}
+		log.Printf("Migrated likes of %d hospitals", count)
+
+		err = rebuildLikeCounts(likeCollection, likeCountCollection)
+		if err != nil {
+			log.Println("Failed to rebuild like counts: " + err.Error())
+			return false
+		}
+		log.Println("Rebuilt like counts")
+		return true
+
+	case CommandReconcile:
+		return reconcile(db)
+
+	case CommandAddQuestionConditions:
+		return addDefaultSurveyQuestionConditions(db.Collection(SurveyQuestionCollectionName))
+
+	case CommandExcludeInapplicable:
+		questionnaire, err := getLatestSurveyQuestionnaire(db.Collection(SurveyQuestionCollectionName))
+		if err != nil {
+			log.Println("Failed to get survey questionnaire: " + err.Error())
+			return false
+		}
+		count, err := excludeInapplicableSurveyAnswers(surveyCollection, questionnaire)
+		if err != nil {
+			log.Println("Failed to exclude inapplicable survey answers: " + err.Error())
+			return false
+		}
+		log.Printf("Excluded inapplicable answers of %d surveys", count)
+		if count == 0 {
+			return true
+		}
+		return runCommand(CommandRebuildSurveySummaries, db)
+
+	// e.g. -command add-admin-key -admin-name alice
+	case CommandAddAdminKey:
+		return addAdminKey(settingCollection, _commandAdminName)
+
+	case CommandRemoveAdminKey:
+		if _commandAdminName == "" {
+			log.Println("Admin name is required, set it with -admin-name")
+			return false
+		}
+		if !removeAdminKey(settingCollection, _commandAdminName) {
+			return false
+		}
+		log.Println("Removed admin key of " + _commandAdminName)
+		return true
+
+	default:
+		log.Printf("Unknown command: %s, available commands: %v", command, CommandNames)
+		return false
+	}
+}
@@ -1,26 +1,145 @@
 package main
 
+import "time"
+
 const (
 	AppName     = "SotamBackend"
 	Version     = "1.0.0"
 	DefaultPort = 8080
 
+	// Command
+	CommandRebuildSurveySummaries = "rebuild-survey-summaries"
+	CommandVerifySurveySummaries  = "verify-survey-summaries"
+	CommandMigrateLikes           = "migrate-likes"
+	CommandReconcile              = "reconcile"
+	CommandAddQuestionConditions  = "add-question-conditions"
+	CommandExcludeInapplicable    = "exclude-inapplicable-answers"
+	CommandAddAdminKey            = "add-admin-key"
+	CommandRemoveAdminKey         = "remove-admin-key"
+
+	// Score
+	ScoreRefreshInterval = time.Hour
+
+	// Waiting report
+	WaitingReportTtl      = 8 * 7 * 24 * time.Hour // Kept for busyness profiles
+	WaitingReportWindow   = time.Hour              // Reports for the current waiting estimate
+	WaitingReportHalfLife = 20 * time.Minute
+	WaitingReportInterval = 10 * time.Minute // Reports of a user within the interval are replaced
+
+	// Busyness
+	BusynessRefreshInterval = 6 * time.Hour
+	BusynessWaitingWeight   = 0.7 // Weight of waiting reports over survey counts
+
+	// Trending
+	ActivityEventTtl      = 35 * 24 * time.Hour // Longer than the trending window
+	TrendingWindow        = 30 * 24 * time.Hour
+	TrendingRecentWindow  = 7 * 24 * time.Hour
+	TrendingRecentWeight  = 3.0 // Weight of events in the recent window over older ones
+	TrendingLikeWeight    = 1.0
+	TrendingUnlikeWeight  = -1.0
+	TrendingSurveyWeight  = 2.0
+	TrendingRadiusKm      = 5.0
+	EarthRadiusKm         = 6378.1
+	TrendingPageableCount = 10
+
+	// Trust
+	TrustRefreshInterval    = 24 * time.Hour
+	TrustNewUser            = 0.5 // Trust of users not scored yet, and the floor of the age factor
+	TrustMatureAge          = 30 * 24 * time.Hour
+	TrustBurstWindow        = 10 * time.Minute
+	TrustBurstLimit         = 3   // Surveys in the burst window without penalty
+	TrustReportPenalty      = 0.5 // Multiplied for each upheld report
+	TrustVarianceMinSurveys = 3   // Surveys to check the answer variance
+	TrustUniformPenalty     = 0.5 // Penalty when every answer is the same on all surveys
+	TrustMin                = 0.05
+	SurveyWeightTolerance   = 1e-6
+
+	// Favorite list
+	FavoriteListLimit         = 20 // Lists per user
+	FavoriteListHospitalLimit = 100
+	FavoriteListNameMaxLength = 50
+	ShareTokenBytes           = 16
+
+	// Transfer
+	TransferCodeTtl    = 24 * time.Hour
+	TransferCodeLength = 10
+
+	// Device auth
+	AuthModeLegacy               = "legacy" // Requests without tokens are trusted, during the transition
+	AuthModeStrict               = "strict" // Device tokens are required
+	DeviceTokenTtl               = 90 * 24 * time.Hour
+	AuthKeyRotationInterval      = 30 * 24 * time.Hour
+	AuthKeyRotationCheckInterval = 24 * time.Hour
+	AuthKeyBytes                 = 32
+	AdminKeyBytes                = 32
+
+	// Rate limit, requests per period for each user
+	RateLimitKeyLike              = "like"
+	RateLimitKeySurveySubmit      = "survey_submit"
+	RateLimitKeyAnnouncementPost  = "announcement_post"
+	RateLimitKeyTransfer          = "transfer"
+	RateLimitLikeRequests         = 30
+	RateLimitSurveySubmitRequests = 5
+	RateLimitAnnouncementRequests = 10
+	RateLimitTransferRequests     = 3 // Transfer codes can be guessed
+	RateLimitPeriod               = time.Minute
+	RateLimitIpMultiplier         = 5 // Users behind a NAT share an IP
+	RateLimitCleanupInterval      = 10 * time.Minute
+
+	// Language
+	DefaultLanguage = "ko"
+
 	// Profiler
-	ProfileKeyGetHospitals     = "get_hospitals"
-	ProfileKeyGetMoonlights    = "get_moonlights"
-	ProfileKeyGetSurveySummary = "get_survey_summary"
+	ProfileKeyGetHospitals       = "get_hospitals"
+	ProfileKeyGetMoonlights      = "get_moonlights"
+	ProfileKeyGetSurveySummary   = "get_survey_summary"
+	ProfileKeyGetSurveySummaries = "get_survey_summaries"
+	ProfileKeyGetTrending        = "get_trending"
+
+	// Cache
+	CacheKeyHoliday             = "holiday"
+	CacheKeyGeneralInfo         = "general_info"
+	CacheKeySurveyQuestionnaire = "survey_questionnaire"
+	CacheKeyScoreModel          = "score_model"
+	CacheKeyAuthKeys            = "auth_keys"
+	CacheKeyAdminKeys           = "admin_keys"
+	ReferenceCacheTtl           = 10 * time.Minute
 
 	// Database
-	MongoUri                   = "mongodb://mongo:27017"
-	HospitalDatabaseName       = "hospital_database"
-	InfoCollectionName         = "info"
-	HospitalCollectionName     = "hospitals"
-	MoonlightCollectionName    = "moonlights"
-	HolidayCollectionName      = "holidays"
-	SurveyCollectionName       = "surveys"
-	LikeCollectionName         = "likes"
-	UserCollectionName         = "users"
-	AnnouncementCollectionName = "announcements"
+	MongoUri                      = "mongodb://mongo:27017"
+	HospitalDatabaseName          = "hospital_database"
+	InfoCollectionName            = "info"
+	HospitalCollectionName        = "hospitals"
+	MoonlightCollectionName       = "moonlights"
+	HolidayCollectionName         = "holidays"
+	SurveyCollectionName          = "surveys"
+	LikeCollectionName            = "likes"
+	LikeCountCollectionName       = "like_counts"
+	UserCollectionName            = "users"
+	AnnouncementCollectionName    = "announcements"
+	SurveyQuestionCollectionName  = "survey_questions"
+	SurveyTipCollectionName       = "survey_tips"
+	SurveySummaryCollectionName   = "survey_summaries"
+	SettingCollectionName         = "settings"
+	SurveyReportCollectionName    = "survey_reports"
+	ModerationLogCollectionName   = "moderation_logs"
+	SurveyVoteCollectionName      = "survey_votes"
+	WaitingReportCollectionName   = "waiting_reports"
+	BusynessProfileCollectionName = "busyness_profiles"
+	ActivityEventCollectionName   = "activity_events"
+	FavoriteListCollectionName    = "favorite_lists"
+	DeviceCollectionName          = "devices"
+	TransferCodeCollectionName    = "transfer_codes"
+
+	// Setting document IDs
+	SettingKeyScoreModel   = "scoreModel"
+	SettingKeyAuthKeys     = "authKeys"
+	SettingKeyAdminKeys    = "adminKeys"
+	SettingKeyTrustRefresh = "trustRefresh"
+
+	// Moderation
+	PiiReplacement            = "***"
+	SurveyReportHideThreshold = 3 // Open reports to hide a survey until reviewed
 
 	// Government
 	GovApiKey     = "N/A"
@@ -29,5 +148,8 @@ const (
 	// Backend API
 	HospitalPageableCount     = 15
 	AnnouncementPageableCount = 10
+	SurveyTipPageableCount    = 10
+	SurveyReportPageableCount = 20
+	SurveySummaryBatchLimit   = 50
 	TimestampFormat           = "2006-01-02 15:04:05"
 )
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Everything stored about a user, for personal data requests.
+// Ids of other users (reporters, moderators, authors) are left out.
+type UserDataExport struct {
+	UserId          string                   `json:"userId"`
+	ExportedAt      string                   `json:"exportedAt"`
+	User            *UserDocumentExport      `json:"user"`
+	Device          *DeviceExport            `json:"device"`
+	Surveys         []SurveyExport           `json:"surveys"`
+	Tips            []SurveyTipDocument      `json:"tips"`
+	Likes           []HospitalActivityExport `json:"likes"`
+	ReportsFiled    []SurveyReportExport     `json:"reportsFiled"`
+	ReportsReceived []SurveyReportExport     `json:"reportsReceived"`
+	ModerationLogs  []ModerationLogExport    `json:"moderationLogs"`
+	VotesCast       []HospitalActivityExport `json:"votesCast"`     // Helpful votes on surveys of others
+	VotesReceived   []SurveyVoteExport       `json:"votesReceived"` // Helpful votes on own surveys
+	WaitingReports  []WaitingReportExport    `json:"waitingReports"`
+	ActivityEvents  []ActivityEventExport    `json:"activityEvents"`
+	FavoriteLists   []FavoriteListDocument   `json:"favoriteLists"`
+}
+
+type UserDocumentExport struct {
+	Surveys     []string `json:"surveys"`
+	Trust       float64  `json:"trust"`
+	TrustUpdate string   `json:"trustUpdate"`
+}
+
+type DeviceExport struct {
+	Legacy       bool   `json:"legacy"`
+	RegisteredAt string `json:"registeredAt"`
+	RefreshedAt  string `json:"refreshedAt"`
+}
+
+type SurveyExport struct {
+	HospitalId           string                  `json:"hospitalId"`
+	HospitalName         string                  `json:"hospitalName"`
+	Timestamp            Timestamp               `json:"timestamp"`
+	QuestionnaireVersion int                     `json:"questionnaireVersion"`
+	Answers              map[string]SurveyAnswer `json:"answers"`
+	Hidden               bool                    `json:"hidden"`
+}
+
+type HospitalActivityExport struct {
+	HospitalId   string `json:"hospitalId"`
+	HospitalName string `json:"hospitalName"`
+	Timestamp    string `json:"timestamp,omitempty"`
+}
+
+type SurveyReportExport struct {
+	HospitalId   string `json:"hospitalId"`
+	HospitalName string `json:"hospitalName"`
+	Reason       string `json:"reason"`
+	Comment      string `json:"comment,omitempty"` // Only for the reports filed by the user
+	State        string `json:"state"`
+	Timestamp    string `json:"timestamp"`
+}
+
+type ModerationLogExport struct {
+	HospitalId string `json:"hospitalId"`
+	Action     string `json:"action"`
+	Note       string `json:"note"`
+	Timestamp  string `json:"timestamp"`
+}
+
+type SurveyVoteExport struct {
+	HospitalId   string `json:"hospitalId"`
+	HospitalName string `json:"hospitalName"`
+	Count        int    `json:"count"`
+}
+
+type WaitingReportExport struct {
+	HospitalId   string `json:"hospitalId"`
+	HospitalName string `json:"hospitalName"`
+	Minutes      string `json:"minutes"`
+	Timestamp    string `json:"timestamp"`
+}
+
+type ActivityEventExport struct {
+	HospitalId string `json:"hospitalId"`
+	Type       string `json:"type"`
+	Timestamp  string `json:"timestamp"`
+}
+
+func findAllDocuments[T any](collection *mongo.Collection, filter bson.M) ([]T, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	cursor, err := collection.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", collection.Name(), err)
+	}
+	defer cursor.Close(context.Background())
+
+	documents := []T{}
+	if err = cursor.All(context.Background(), &documents); err != nil {
+		return nil, fmt.Errorf("%s: %w", collection.Name(), err)
+	}
+	return documents, nil
+}
+
+// Names of hospitals and moonlights by id
+func getHospitalNames(hospitalCollection *mongo.Collection,
+	moonlightCollection *mongo.Collection, hospitalIds []string) (map[string]string, error) {
+	names := map[string]string{}
+	opts := options.Find().SetProjection(bson.M{"dutyName": 1})
+	for _, collection := range []*mongo.Collection{hospitalCollection, moonlightCollection} {
+		cursor, err := collection.Find(context.Background(), bson.M{"_id": bson.M{"$in": hospitalIds}}, opts)
+		if err != nil {
+			return nil, err
+		}
+		var documents []DatabaseHospital
+		if err = cursor.All(context.Background(), &documents); err != nil {
+			return nil, err
+		}
+		for _, document := range documents {
+			names[document.Hpid] = document.DutyName
+		}
+	}
+	return names, nil
+}
+
+func writeUserDataZip(w http.ResponseWriter, export UserDataExport) error {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"user_data_%s.zip\"", export.UserId))
+
+	sections := []struct {
+		name  string
+		value any
+	}{
+		{"user", export.User},
+		{"device", export.Device},
+		{"surveys", export.Surveys},
+		{"tips", export.Tips},
+		{"likes", export.Likes},
+		{"reports_filed", export.ReportsFiled},
+		{"reports_received", export.ReportsReceived},
+		{"moderation_logs", export.ModerationLogs},
+		{"votes_cast", export.VotesCast},
+		{"votes_received", export.VotesReceived},
+		{"waiting_reports", export.WaitingReports},
+		{"activity_events", export.ActivityEvents},
+		{"favorite_lists", export.FavoriteLists},
+	}
+
+	archive := zip.NewWriter(w)
+	for _, section := range sections {
+		file, err := archive.Create(section.name + ".json")
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		if err = encoder.Encode(section.value); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// Export all data of the user as JSON, or as a ZIP of JSON files with format=zip
+func handleGetUserDataExport(
+	userCollection *mongo.Collection,
+	deviceCollection *mongo.Collection,
+	surveyCollection *mongo.Collection,
+	tipCollection *mongo.Collection,
+	likeCollection *mongo.Collection,
+	reportCollection *mongo.Collection,
+	logCollection *mongo.Collection,
+	voteCollection *mongo.Collection,
+	waitingCollection *mongo.Collection,
+	activityCollection *mongo.Collection,
+	listCollection *mongo.Collection,
+	hospitalCollection *mongo.Collection,
+	moonlightCollection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if userCollection.Name() != UserCollectionName ||
+			deviceCollection.Name() != DeviceCollectionName ||
+			surveyCollection.Name() != SurveyCollectionName ||
+			tipCollection.Name() != SurveyTipCollectionName ||
+			likeCollection.Name() != LikeCollectionName ||
+			reportCollection.Name() != SurveyReportCollectionName ||
+			logCollection.Name() != ModerationLogCollectionName ||
+			voteCollection.Name() != SurveyVoteCollectionName ||
+			waitingCollection.Name() != WaitingReportCollectionName ||
+			activityCollection.Name() != ActivityEventCollectionName ||
+			listCollection.Name() != FavoriteListCollectionName ||
+			hospitalCollection.Name() != HospitalCollectionName ||
+			moonlightCollection.Name() != MoonlightCollectionName {
+			log.Println("Wrong collection is assigned")
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+
+		userId := r.URL.Query().Get("userId")
+		if userId == "" {
+			http.Error(w, "userId is empty", http.StatusBadRequest)
+			return
+		}
+		format := r.URL.Query().Get("format")
+		if format != "" && format != "json" && format != "zip" {
+			http.Error(w, "format should be json or zip", http.StatusBadRequest)
+			return
+		}
+
+		fail := func(err error) {
+			http.Error(w, "Error while exporting user data", http.StatusInternalServerError)
+			log.Println("Failed to export user data of " + userId + ": " + err.Error())
+		}
+
+		export := UserDataExport{
+			UserId:     userId,
+			ExportedAt: time.Now().Format(TimestampFormat),
+		}
+
+		var user UserDocument
+		err := userCollection.FindOne(context.Background(), bson.M{"_id": userId}).Decode(&user)
+		if err == nil {
+			export.User = &UserDocumentExport{Surveys: user.Surveys,
+				Trust: user.Trust, TrustUpdate: user.TrustUpdate}
+		} else if err != mongo.ErrNoDocuments {
+			fail(err)
+			return
+		}
+		var device DeviceDocument
+		err = deviceCollection.FindOne(context.Background(), bson.M{"_id": userId}).Decode(&device)
+		if err == nil {
+			export.Device = &DeviceExport{Legacy: device.Legacy,
+				RegisteredAt: device.RegisteredAt, RefreshedAt: device.RefreshedAt}
+		} else if err != mongo.ErrNoDocuments {
+			fail(err)
+			return
+		}
+
+		filter := bson.M{"userId": userId}
+		surveys, err := findAllDocuments[SurveyAnswerDocument](surveyCollection, filter)
+		if err != nil {
+			fail(err)
+			return
+		}
+		export.Tips, err = findAllDocuments[SurveyTipDocument](tipCollection, filter)
+		if err != nil {
+			fail(err)
+			return
+		}
+		likes, err := findAllDocuments[LikeDocument](likeCollection, filter)
+		if err != nil {
+			fail(err)
+			return
+		}
+		reportsFiled, err := findAllDocuments[SurveyReportDocument](reportCollection, bson.M{"reporterId": userId})
+		if err != nil {
+			fail(err)
+			return
+		}
+		reportsReceived, err := findAllDocuments[SurveyReportDocument](reportCollection, filter)
+		if err != nil {
+			fail(err)
+			return
+		}
+		logs, err := findAllDocuments[ModerationLogDocument](logCollection, filter)
+		if err != nil {
+			fail(err)
+			return
+		}
+		votesCast, err := findAllDocuments[SurveyVoteDocument](voteCollection, bson.M{"voterIds": userId})
+		if err != nil {
+			fail(err)
+			return
+		}
+		votesReceived, err := findAllDocuments[SurveyVoteDocument](voteCollection, filter)
+		if err != nil {
+			fail(err)
+			return
+		}
+		waitingReports, err := findAllDocuments[WaitingReportDocument](waitingCollection, filter)
+		if err != nil {
+			fail(err)
+			return
+		}
+		events, err := findAllDocuments[ActivityEventDocument](activityCollection, filter)
+		if err != nil {
+			fail(err)
+			return
+		}
+		export.FavoriteLists, err = findAllDocuments[FavoriteListDocument](listCollection, filter)
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		// Names of the hospitals in the export
+		hospitalIds := []string{}
+		for _, survey := range surveys {
+			hospitalIds = append(hospitalIds, survey.HospitalId)
+		}
+		for _, like := range likes {
+			hospitalIds = append(hospitalIds, like.HospitalId)
+		}
+		for _, reports := range [][]SurveyReportDocument{reportsFiled, reportsReceived} {
+			for _, report := range reports {
+				hospitalIds = append(hospitalIds, report.HospitalId)
+			}
+		}
+		for _, votes := range [][]SurveyVoteDocument{votesCast, votesReceived} {
+			for _, vote := range votes {
+				hospitalIds = append(hospitalIds, vote.HospitalId)
+			}
+		}
+		for _, report := range waitingReports {
+			hospitalIds = append(hospitalIds, report.HospitalId)
+		}
+		names, err := getHospitalNames(hospitalCollection, moonlightCollection, hospitalIds)
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		export.Surveys = []SurveyExport{}
+		for _, survey := range surveys {
+			export.Surveys = append(export.Surveys, SurveyExport{
+				HospitalId:           survey.HospitalId,
+				HospitalName:         names[survey.HospitalId],
+				Timestamp:            survey.Timestamp,
+				QuestionnaireVersion: survey.QuestionnaireVersion,
+				Answers:              survey.Answers,
+				Hidden:               survey.Hidden,
+			})
+		}
+		export.Likes = []HospitalActivityExport{}
+		for _, like := range likes {
+			export.Likes = append(export.Likes, HospitalActivityExport{
+				HospitalId:   like.HospitalId,
+				HospitalName: names[like.HospitalId],
+				Timestamp:    like.Timestamp.Local().Format(TimestampFormat),
+			})
+		}
+		export.ReportsFiled = []SurveyReportExport{}
+		for _, report := range reportsFiled {
+			export.ReportsFiled = append(export.ReportsFiled, SurveyReportExport{
+				HospitalId:   report.HospitalId,
+				HospitalName: names[report.HospitalId],
+				Reason:       report.Reason,
+				Comment:      report.Comment,
+				State:        report.State,
+				Timestamp:    report.Timestamp,
+			})
+		}
+		export.ReportsReceived = []SurveyReportExport{}
+		for _, report := range reportsReceived {
+			export.ReportsReceived = append(export.ReportsReceived, SurveyReportExport{
+				HospitalId:   report.HospitalId,
+				HospitalName: names[report.HospitalId],
+				Reason:       report.Reason,
+				State:        report.State,
+				Timestamp:    report.Timestamp,
+			})
+		}
+		export.ModerationLogs = []ModerationLogExport{}
+		for _, document := range logs {
+			export.ModerationLogs = append(export.ModerationLogs, ModerationLogExport{
+				HospitalId: document.HospitalId,
+				Action:     document.Action,
+				Note:       document.Note,
+				Timestamp:  document.Timestamp,
+			})
+		}
+		export.VotesCast = []HospitalActivityExport{}
+		for _, vote := range votesCast {
+			export.VotesCast = append(export.VotesCast, HospitalActivityExport{
+				HospitalId:   vote.HospitalId,
+				HospitalName: names[vote.HospitalId],
+			})
+		}
+		export.VotesReceived = []SurveyVoteExport{}
+		for _, vote := range votesReceived {
+			export.VotesReceived = append(export.VotesReceived, SurveyVoteExport{
+				HospitalId:   vote.HospitalId,
+				HospitalName: names[vote.HospitalId],
+				Count:        vote.Count,
+			})
+		}
+		export.WaitingReports = []WaitingReportExport{}
+		for _, report := range waitingReports {
+			export.WaitingReports = append(export.WaitingReports, WaitingReportExport{
+				HospitalId:   report.HospitalId,
+				HospitalName: names[report.HospitalId],
+				Minutes:      report.Minutes,
+				Timestamp:    report.Timestamp.Local().Format(TimestampFormat),
+			})
+		}
+		export.ActivityEvents = []ActivityEventExport{}
+		for _, event := range events {
+			export.ActivityEvents = append(export.ActivityEvents, ActivityEventExport{
+				HospitalId: event.HospitalId,
+				Type:       event.Type,
+				Timestamp:  event.Timestamp.Local().Format(TimestampFormat),
+			})
+		}
+
+		if format == "zip" {
+			if err = writeUserDataZip(w, export); err != nil {
+				log.Println("Failed to write user data zip of " + userId + ": " + err.Error())
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(export)
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Named list of hospitals owned by a user, viewable by others with the share token
+type FavoriteListDocument struct {
+	Id          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserId      string             `bson:"userId" json:"userId"`
+	Name        string             `bson:"name" json:"name"`
+	HospitalIds []string           `bson:"hospitalIds" json:"hospitalIds"`
+	ShareToken  string             `bson:"shareToken,omitempty" json:"shareToken,omitempty"` // Empty if not shared
+	Timestamp   string             `bson:"timestamp" json:"timestamp"`                       // Last update
+}
+
+type FavoriteListRequest struct {
+	Id          string   `json:"id"` // Empty when creating
+	UserId      string   `json:"userId"`
+	Name        string   `json:"name"`
+	HospitalIds []string `json:"hospitalIds"`
+}
+
+type FavoriteListShareRequest struct {
+	Id     string `json:"id"`
+	UserId string `json:"userId"`
+	Revoke bool   `json:"revoke"` // Invalidate the share token
+}
+
+type FavoriteListsResponse struct {
+	Lists []FavoriteListDocument `json:"lists"`
+}
+
+// Read-only view of a shared list, without the owner
+type SharedFavoriteListResponse struct {
+	Name      string             `json:"name"`
+	Hospitals []ResponseHospital `json:"hospitals"`
+	Timestamp string             `json:"timestamp"`
+}
+
+func ensureFavoriteListCollectionIndex(collection *mongo.Collection) bool {
+	if collection.Name() != FavoriteListCollectionName {
+		log.Printf("Got wrong collection: %s", collection.Name())
+		return false
+	}
+
+	indexModels := []mongo.IndexModel{
+		// Finding lists of a user
+		{
+			Keys: bson.D{
+				{Key: "userId", Value: 1}, // 1 for ascending order
+			},
+		},
+		// Finding a shared list, only for shared ones
+		{
+			Keys: bson.D{
+				{Key: "shareToken", Value: 1},
+			},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"shareToken": bson.M{"$type": "string"}}),
+		},
+	}
+
+	_, err := collection.Indexes().CreateMany(context.Background(), indexModels)
+	if err != nil {
+		log.Println("Could not create index in favorite list collection: " + err.Error())
+		return false
+	}
+	log.Println("Favorite list collection index created successfully")
+	return true
+}
+
+func newShareToken() (string, error) {
+	bytes := make([]byte, ShareTokenBytes)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+// Validate the request, and remove duplicated hospital ids keeping the order
+func validateFavoriteListRequest(hospitalCollection *mongo.Collection,
+	request *FavoriteListRequest) ([]FieldError, error) {
+	fieldErrors := []FieldError{}
+	if request.UserId == "" {
+		fieldErrors = append(fieldErrors, FieldError{Field: "userId", Message: "userId is empty"})
+	}
+	if request.Name == "" {
+		fieldErrors = append(fieldErrors, FieldError{Field: "name", Message: "name is empty"})
+	} else if utf8.RuneCountInString(request.Name) > FavoriteListNameMaxLength {
+		fieldErrors = append(fieldErrors, FieldError{Field: "name",
+			Message: fmt.Sprintf("name should be at most %d characters", FavoriteListNameMaxLength)})
+	}
+
+	hospitalIds := []string{}
+	found := map[string]bool{}
+	for _, hospitalId := range request.HospitalIds {
+		if hospitalId != "" && !found[hospitalId] {
+			found[hospitalId] = true
+			hospitalIds = append(hospitalIds, hospitalId)
+		}
+	}
+	request.HospitalIds = hospitalIds
+
+	if len(hospitalIds) > FavoriteListHospitalLimit {
+		fieldErrors = append(fieldErrors, FieldError{Field: "hospitalIds",
+			Message: fmt.Sprintf("at most %d hospitals are allowed", FavoriteListHospitalLimit)})
+	} else if len(hospitalIds) > 0 {
+		count, err := hospitalCollection.CountDocuments(context.Background(),
+			bson.M{"_id": bson.M{"$in": hospitalIds}})
+		if err != nil {
+			return nil, err
+		}
+		if int(count) != len(hospitalIds) {
+			fieldErrors = append(fieldErrors, FieldError{Field: "hospitalIds",
+				Message: "some hospitals do not exist"})
+		}
+	}
+	return fieldErrors, nil
+}
+
+func handleGetFavoriteLists(collection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if collection.Name() != FavoriteListCollectionName {
+			log.Printf("Got wrong collection: %s", collection.Name())
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+
+		userId := r.URL.Query().Get("userId")
+		if userId == "" {
+			http.Error(w, "userId is empty", http.StatusBadRequest)
+			return
+		}
+
+		// Oldest first, in the order of creation
+		opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+		cursor, err := collection.Find(context.Background(), bson.M{"userId": userId}, opts)
+		if err != nil {
+			log.Println("Error while finding favorite lists: " + err.Error())
+			http.Error(w, "Error while finding favorite lists", http.StatusInternalServerError)
+			return
+		}
+		defer cursor.Close(context.Background())
+
+		response := FavoriteListsResponse{Lists: []FavoriteListDocument{}}
+		if err = cursor.All(context.Background(), &response.Lists); err != nil {
+			log.Println("Error while decoding favorite lists: " + err.Error())
+			http.Error(w, "Error while decoding favorite lists", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// Create a list with POST, or replace the name and hospitals of a list with PUT
+func handlePostFavoriteList(listCollection *mongo.Collection,
+	hospitalCollection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			http.Error(w, "Only POST or PUT method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if listCollection.Name() != FavoriteListCollectionName ||
+			hospitalCollection.Name() != HospitalCollectionName {
+			log.Println("Wrong collection is assigned")
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+
+		var request FavoriteListRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Println("Failed to decode favorite list request: " + err.Error())
+			return
+		}
+
+		fieldErrors, err := validateFavoriteListRequest(hospitalCollection, &request)
+		if err != nil {
+			http.Error(w, "Error while finding hospitals", http.StatusInternalServerError)
+			log.Println("Failed to find hospitals of favorite list: " + err.Error())
+			return
+		}
+		var id primitive.ObjectID
+		if r.Method == http.MethodPut {
+			id, err = primitive.ObjectIDFromHex(request.Id)
+			if err != nil {
+				fieldErrors = append(fieldErrors, FieldError{Field: "id", Message: "id is invalid"})
+			}
+		}
+		if len(fieldErrors) > 0 {
+			writeFieldErrors(w, fieldErrors)
+			return
+		}
+
+		timestamp := time.Now().Format(TimestampFormat)
+
+		// Update the list of the user
+		if r.Method == http.MethodPut {
+			update := bson.M{"$set": bson.M{
+				"name":        request.Name,
+				"hospitalIds": request.HospitalIds,
+				"timestamp":   timestamp,
+			}}
+			opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+			var document FavoriteListDocument
+			err = listCollection.FindOneAndUpdate(context.Background(),
+				bson.M{"_id": id, "userId": request.UserId}, update, opts).Decode(&document)
+			if err == mongo.ErrNoDocuments {
+				http.Error(w, "Favorite list not found", http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				log.Println("Failed to update favorite list " + request.Id + ": " + err.Error())
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(document)
+			return
+		}
+
+		count, err := listCollection.CountDocuments(context.Background(), bson.M{"userId": request.UserId})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Println("Failed to count favorite lists of " + request.UserId + ": " + err.Error())
+			return
+		}
+		if count >= FavoriteListLimit {
+			writeFieldErrors(w, []FieldError{{Field: "userId",
+				Message: fmt.Sprintf("at most %d lists are allowed", FavoriteListLimit)}})
+			return
+		}
+
+		document := FavoriteListDocument{
+			UserId:      request.UserId,
+			Name:        request.Name,
+			HospitalIds: request.HospitalIds,
+			Timestamp:   timestamp,
+		}
+		result, err := listCollection.InsertOne(context.Background(), document)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Println("Failed to create favorite list of " + request.UserId + ": " + err.Error())
+			return
+		}
+		document.Id = result.InsertedID.(primitive.ObjectID)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(document)
+	}
+}
+
+func handleDeleteFavoriteList(collection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Only DELETE method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if collection.Name() != FavoriteListCollectionName {
+			log.Printf("Got wrong collection: %s", collection.Name())
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+
+		id, err := primitive.ObjectIDFromHex(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "id is invalid", http.StatusBadRequest)
+			return
+		}
+		userId := r.URL.Query().Get("userId")
+		if userId == "" {
+			http.Error(w, "userId is empty", http.StatusBadRequest)
+			return
+		}
+
+		result, err := collection.DeleteOne(context.Background(), bson.M{"_id": id, "userId": userId})
+		if err != nil {
+			http.Error(w, "Error while deleting favorite list", http.StatusInternalServerError)
+			log.Println("Failed to delete favorite list " + id.Hex() + ": " + err.Error())
+			return
+		}
+		if result.DeletedCount == 0 {
+			http.Error(w, "Favorite list not found", http.StatusNotFound)
+			return
+		}
+
+		fmt.Fprintf(w, "Favorite list deleted")
+	}
+}
+
+// Issue a new share token of the list, or revoke it.
+// Issuing again invalidates the previous token.
+func handlePostFavoriteListShare(collection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if collection.Name() != FavoriteListCollectionName {
+			log.Printf("Got wrong collection: %s", collection.Name())
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+
+		var request FavoriteListShareRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Println("Failed to decode favorite list share request: " + err.Error())
+			return
+		}
+		id, err := primitive.ObjectIDFromHex(request.Id)
+		if err != nil {
+			http.Error(w, "id is invalid", http.StatusBadRequest)
+			return
+		}
+		if request.UserId == "" {
+			http.Error(w, "userId is empty", http.StatusBadRequest)
+			return
+		}
+
+		update := bson.M{"$unset": bson.M{"shareToken": ""}}
+		if !request.Revoke {
+			token, err := newShareToken()
+			if err != nil {
+				http.Error(w, "Error while creating share token", http.StatusInternalServerError)
+				log.Println("Failed to create share token: " + err.Error())
+				return
+			}
+			update = bson.M{"$set": bson.M{"shareToken": token}}
+		}
+
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		var document FavoriteListDocument
+		err = collection.FindOneAndUpdate(context.Background(),
+			bson.M{"_id": id, "userId": request.UserId}, update, opts).Decode(&document)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Favorite list not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Println("Failed to share favorite list " + request.Id + ": " + err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(document)
+	}
+}
+
+// Hospitals of a shared list with the current operating status, in the order of the list
+func handleGetSharedFavoriteList(
+	listCollection *mongo.Collection,
+	hospitalCollection *mongo.Collection,
+	holidayCollection *mongo.Collection,
+	surveyCollection *mongo.Collection,
+	likeCountCollection *mongo.Collection,
+	summaryCollection *mongo.Collection,
+	settingCollection *mongo.Collection,
+	waitingCollection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if listCollection.Name() != FavoriteListCollectionName ||
+			hospitalCollection.Name() != HospitalCollectionName ||
+			holidayCollection.Name() != HolidayCollectionName ||
+			surveyCollection.Name() != SurveyCollectionName ||
+			likeCountCollection.Name() != LikeCountCollectionName ||
+			summaryCollection.Name() != SurveySummaryCollectionName ||
+			settingCollection.Name() != SettingCollectionName ||
+			waitingCollection.Name() != WaitingReportCollectionName {
+			log.Println("Wrong collection is assigned")
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			http.Error(w, "token is empty", http.StatusBadRequest)
+			return
+		}
+
+		var list FavoriteListDocument
+		err := listCollection.FindOne(context.Background(), bson.M{"shareToken": token}).Decode(&list)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Shared list not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Println("Error while finding shared favorite list: " + err.Error())
+			http.Error(w, "Error while finding shared favorite list", http.StatusInternalServerError)
+			return
+		}
+
+		cursor, err := hospitalCollection.Find(context.Background(), bson.M{"_id": bson.M{"$in": list.HospitalIds}})
+		if err != nil {
+			log.Println("Error while finding hospitals of shared list: " + err.Error())
+			http.Error(w, "Error while finding hospitals", http.StatusInternalServerError)
+			return
+		}
+		defer cursor.Close(context.Background())
+
+		var documents []DatabaseHospital
+		if err := cursor.All(context.Background(), &documents); err != nil {
+			log.Println("Error while decoding hospitals of shared list: " + err.Error())
+			http.Error(w, "Error while decoding hospitals", http.StatusInternalServerError)
+			return
+		}
+		hospitals := map[string]DatabaseHospital{}
+		for _, document := range documents {
+			hospitals[document.Hpid] = document
+		}
+
+		// Hospitals removed from the database are skipped
+		dayKey := getDayKey(holidayCollection)
+		scoreModel := getScoreModel(settingCollection)
+		response := SharedFavoriteListResponse{
+			Name:      list.Name,
+			Hospitals: []ResponseHospital{},
+			Timestamp: list.Timestamp,
+		}
+		for _, hospitalId := range list.HospitalIds {
+			document, ok := hospitals[hospitalId]
+			if !ok {
+				continue
+			}
+			response.Hospitals = append(response.Hospitals,
+				*newResponseHospital(document, dayKey, surveyCollection, likeCountCollection,
+					summaryCollection, waitingCollection, scoreModel))
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(response)
+	}
+}
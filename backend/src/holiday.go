@@ -20,10 +20,24 @@ type IsTodayHolidayResponse struct {
 	Response int `json:"response"`
 }
 
+func getHolidayDocument(collection *mongo.Collection) (HolidayDocument, error) {
+	value, err := getCachedValue(CacheKeyHoliday, func() (any, error) {
+		var document HolidayDocument
+		err := collection.FindOne(context.Background(), bson.M{}).Decode(&document)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return nil, err
+		}
+		return document, nil
+	})
+	if err != nil {
+		return HolidayDocument{}, err
+	}
+	return value.(HolidayDocument), nil
+}
+
 func getIsTodayHoliday(collection *mongo.Collection) bool {
-	var document HolidayDocument
-	err := collection.FindOne(context.Background(), bson.M{}).Decode(&document)
-	if err != nil && err != mongo.ErrNoDocuments {
+	document, err := getHolidayDocument(collection)
+	if err != nil {
 		log.Println("Holiday DB is empty: " + err.Error())
 		return false
 	}
@@ -7,12 +7,14 @@ import (
 	"log"
 	"net/http"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type GeoJSON struct {
@@ -52,18 +54,21 @@ type DatabaseHospital struct {
 }
 
 type ResponseHospital struct {
-	Hpid              string         `json:"hpid"`
-	Name              string         `json:"name"`              // 기관명
-	Address           string         `json:"address"`           // 주소
-	Phone             string         `json:"phone"`             // 대표전화1
-	Type              string         `json:"type"`              // 병원분류명 (병원, 의원 등)
-	Subjects          []string       `json:"subjects"`          // 진료과목
-	Coordinates       []float64      `json:"coordinates"`       // [lng, lat]
-	DetailInfo        []string       `json:"detailInfo"`        // 기관설명상세
-	OperatingHoursMap map[int]string `json:"operatingHoursMap"` // Keys: 1 (monday) ~ 8 (holiday)
-	OperatingStatus   string         `json:"operatingStatus"`   // "open", "finished", "unknown", "notOpenedToday"
-	SurveyCount       int            `json:"surveyCount"`
-	LikeCount         int            `json:"likeCount"`
+	Hpid              string           `json:"hpid"`
+	Name              string           `json:"name"`              // 기관명
+	Address           string           `json:"address"`           // 주소
+	Phone             string           `json:"phone"`             // 대표전화1
+	Type              string           `json:"type"`              // 병원분류명 (병원, 의원 등)
+	Subjects          []string         `json:"subjects"`          // 진료과목
+	Coordinates       []float64        `json:"coordinates"`       // [lng, lat]
+	DetailInfo        []string         `json:"detailInfo"`        // 기관설명상세
+	OperatingHoursMap map[int]string   `json:"operatingHoursMap"` // Keys: 1 (monday) ~ 8 (holiday)
+	OperatingStatus   string           `json:"operatingStatus"`   // "open", "finished", "unknown", "notOpenedToday"
+	SurveyCount       int              `json:"surveyCount"`
+	LikeCount         int              `json:"likeCount"`
+	Score             float64          `json:"score"`           // Survey score shrunk toward the regional mean
+	ScoreConfidence   float64          `json:"scoreConfidence"` // 0 ~ 1, grows with the number of answers
+	CurrentWaiting    *WaitingEstimate `json:"currentWaiting"`  // Null if nobody reported in the last hour
 }
 
 type HospotalListResponse struct {
@@ -85,6 +90,19 @@ func getDayKey(holidayCollection *mongo.Collection) int {
 	return day
 }
 
+func checkHospitalExists(collection *mongo.Collection, hospitalId string) (bool, error) {
+	if collection.Name() != HospitalCollectionName {
+		return false, fmt.Errorf("got wrong collection: %s", collection.Name())
+	}
+
+	count, err := collection.CountDocuments(context.Background(),
+		bson.M{"_id": hospitalId}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
 func getFilterWithStatusParam(filter bson.M, status string, dayKey int) bson.M {
 	if status == "openToday" || status == "openNow" || status == "openSunday" {
 		if status == "openSunday" {
@@ -112,7 +130,10 @@ func getFilterWithStatusParam(filter bson.M, status string, dayKey int) bson.M {
 func newResponseHospital(data DatabaseHospital,
 	dayKey int,
 	surveyCollection *mongo.Collection,
-	likeCollection *mongo.Collection) *ResponseHospital {
+	likeCountCollection *mongo.Collection,
+	summaryCollection *mongo.Collection,
+	waitingCollection *mongo.Collection,
+	scoreModel ScoreModel) *ResponseHospital {
 	response := ResponseHospital{
 		Hpid:              data.Hpid,
 		Name:              data.DutyName,
@@ -126,6 +147,9 @@ func newResponseHospital(data DatabaseHospital,
 		OperatingStatus:   "unknown",
 		SurveyCount:       0,
 		LikeCount:         0,
+		Score:             0,
+		ScoreConfidence:   0,
+		CurrentWaiting:    nil,
 	}
 
 	// DetailInfo
@@ -195,7 +219,17 @@ func newResponseHospital(data DatabaseHospital,
 	response.SurveyCount = getSurveyCount(surveyCollection, data.Hpid)
 
 	// LikeCount
-	response.LikeCount = getLikeCount(likeCollection, data.Hpid)
+	response.LikeCount = getLikeCount(likeCountCollection, data.Hpid)
+
+	// Score
+	summary, err := getSurveySummaryDocument(summaryCollection, data.Hpid)
+	if err != nil {
+		log.Println("Error while finding survey summary of " + data.Hpid + ": " + err.Error())
+	}
+	response.Score, response.ScoreConfidence = getHospitalScore(scoreModel, summary, data.DutyAddr)
+
+	// CurrentWaiting
+	response.CurrentWaiting = getCurrentWaiting(waitingCollection, data.Hpid)
 
 	return &response
 }
@@ -204,7 +238,10 @@ func handleGetHospital(
 	hospitalCollection *mongo.Collection,
 	holidayCollection *mongo.Collection,
 	surveyCollection *mongo.Collection,
-	likeCollection *mongo.Collection) http.HandlerFunc {
+	likeCountCollection *mongo.Collection,
+	summaryCollection *mongo.Collection,
+	settingCollection *mongo.Collection,
+	waitingCollection *mongo.Collection) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
@@ -214,7 +251,10 @@ func handleGetHospital(
 		if hospitalCollection.Name() != HospitalCollectionName ||
 			holidayCollection.Name() != HolidayCollectionName ||
 			surveyCollection.Name() != SurveyCollectionName ||
-			likeCollection.Name() != LikeCollectionName {
+			likeCountCollection.Name() != LikeCountCollectionName ||
+			summaryCollection.Name() != SurveySummaryCollectionName ||
+			settingCollection.Name() != SettingCollectionName ||
+			waitingCollection.Name() != WaitingReportCollectionName {
 			log.Println("Wrong collection is assigned")
 			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
 			return
@@ -237,8 +277,10 @@ func handleGetHospital(
 
 		// Create response hospitals with extra properties
 		dayKey := getDayKey(holidayCollection)
+		scoreModel := getScoreModel(settingCollection)
 		responseHospitals := []ResponseHospital{
-			*newResponseHospital(document, dayKey, surveyCollection, likeCollection),
+			*newResponseHospital(document, dayKey, surveyCollection, likeCountCollection,
+				summaryCollection, waitingCollection, scoreModel),
 		}
 
 		response := HospotalListResponse{
@@ -255,7 +297,10 @@ func handleGetFilteredHospitals(
 	hospitalCollection *mongo.Collection,
 	holidayCollection *mongo.Collection,
 	surveyCollection *mongo.Collection,
-	likeCollection *mongo.Collection) http.HandlerFunc {
+	likeCountCollection *mongo.Collection,
+	summaryCollection *mongo.Collection,
+	settingCollection *mongo.Collection,
+	waitingCollection *mongo.Collection) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		begin := time.Now()
 
@@ -267,7 +312,10 @@ func handleGetFilteredHospitals(
 		if hospitalCollection.Name() != HospitalCollectionName ||
 			holidayCollection.Name() != HolidayCollectionName ||
 			surveyCollection.Name() != SurveyCollectionName ||
-			likeCollection.Name() != LikeCollectionName {
+			likeCountCollection.Name() != LikeCountCollectionName ||
+			summaryCollection.Name() != SurveySummaryCollectionName ||
+			settingCollection.Name() != SettingCollectionName ||
+			waitingCollection.Name() != WaitingReportCollectionName {
 			log.Println("Wrong collection is assigned")
 			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
 			return
@@ -343,6 +391,16 @@ func handleGetFilteredHospitals(
 			},
 			sampleStage,
 		}
+
+		// Take the best scored hospitals instead of sampling
+		sortByScore := r.URL.Query().Get("sort") == "score"
+		if sortByScore {
+			pipeline = append(mongo.Pipeline{
+				bson.D{
+					{Key: "$match", Value: filter},
+				},
+			}, getScoreSortStages(HospitalPageableCount+1)...)
+		}
 		cursor, err := hospitalCollection.Aggregate(context.Background(), pipeline)
 		if err != nil {
 			log.Println("Error in FilteredHospital: collection.Aggregate: " + err.Error())
@@ -359,10 +417,15 @@ func handleGetFilteredHospitals(
 		}
 
 		// Create response hospitals with extra properties
+		scoreModel := getScoreModel(settingCollection)
 		var responseHospitals []ResponseHospital
 		for i := 0; i < min(len(documents), HospitalPageableCount); i++ {
 			responseHospitals = append(responseHospitals,
-				*newResponseHospital(documents[i], dayKey, surveyCollection, likeCollection))
+				*newResponseHospital(documents[i], dayKey, surveyCollection, likeCountCollection,
+					summaryCollection, waitingCollection, scoreModel))
+		}
+		if sortByScore {
+			sortHospitalsByScore(responseHospitals)
 		}
 
 		// TODO: When server becomes more powerful,
@@ -383,7 +446,10 @@ func handleGetAllMoonlights(
 	moonlightCollection *mongo.Collection,
 	holidayCollection *mongo.Collection,
 	surveyCollection *mongo.Collection,
-	likeCollection *mongo.Collection) http.HandlerFunc {
+	likeCountCollection *mongo.Collection,
+	summaryCollection *mongo.Collection,
+	settingCollection *mongo.Collection,
+	waitingCollection *mongo.Collection) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		begin := time.Now()
 
@@ -395,7 +461,10 @@ func handleGetAllMoonlights(
 		if moonlightCollection.Name() != MoonlightCollectionName ||
 			holidayCollection.Name() != HolidayCollectionName ||
 			surveyCollection.Name() != SurveyCollectionName ||
-			likeCollection.Name() != LikeCollectionName {
+			likeCountCollection.Name() != LikeCountCollectionName ||
+			summaryCollection.Name() != SurveySummaryCollectionName ||
+			settingCollection.Name() != SettingCollectionName ||
+			waitingCollection.Name() != WaitingReportCollectionName {
 			log.Println("Wrong collection is assigned")
 			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
 			return
@@ -461,10 +530,15 @@ func handleGetAllMoonlights(
 		}
 
 		// Create response hospitals
+		scoreModel := getScoreModel(settingCollection)
 		var responseHospitals []ResponseHospital
 		for _, document := range documents {
 			responseHospitals = append(responseHospitals,
-				*newResponseHospital(document, dayKey, surveyCollection, likeCollection))
+				*newResponseHospital(document, dayKey, surveyCollection, likeCountCollection,
+					summaryCollection, waitingCollection, scoreModel))
+		}
+		if r.URL.Query().Get("sort") == "score" {
+			sortHospitalsByScore(responseHospitals)
 		}
 
 		response := HospotalListResponse{
@@ -478,3 +552,42 @@ func handleGetAllMoonlights(
 		profilePerformance(ProfileKeyGetMoonlights, begin)
 	}
 }
+
+// Stages to sort hospitals by the score stored by the score refresher.
+// Hospitals without surveys have no score and come after the scored ones.
+func getScoreSortStages(limit int) mongo.Pipeline {
+	return mongo.Pipeline{
+		bson.D{{Key: "$sort", Value: bson.D{
+			{Key: "score", Value: -1}, // -1 for descending order
+			{Key: "_id", Value: 1},
+		}}},
+		bson.D{{Key: "$limit", Value: limit}},
+	}
+}
+
+func ensureHospitalCollectionIndex(collection *mongo.Collection) bool {
+	if collection.Name() != HospitalCollectionName {
+		log.Printf("Got wrong collection: %s", collection.Name())
+		return false
+	}
+
+	// For sorting hospitals by score
+	indexModel := mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "score", Value: -1},
+			{Key: "_id", Value: 1},
+		},
+	}
+	_, err := collection.Indexes().CreateOne(context.Background(), indexModel)
+	if err != nil {
+		log.Println("Could not create index in hospital collection: " + err.Error())
+		return false
+	}
+	return true
+}
+
+func sortHospitalsByScore(hospitals []ResponseHospital) {
+	sort.SliceStable(hospitals, func(i, j int) bool {
+		return hospitals[i].Score > hospitals[j].Score
+	})
+}
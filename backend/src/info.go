@@ -25,6 +25,21 @@ type LastInfoUpdateResponse struct {
 	Timestamp string `json:"timestamp"`
 }
 
+func getGeneralInfo(collection *mongo.Collection) (GeneralInfo, error) {
+	value, err := getCachedValue(CacheKeyGeneralInfo, func() (any, error) {
+		var generalInfo GeneralInfo
+		err := collection.FindOne(context.Background(), bson.M{}).Decode(&generalInfo)
+		if err != nil {
+			return nil, err
+		}
+		return generalInfo, nil
+	})
+	if err != nil {
+		return GeneralInfo{}, err
+	}
+	return value.(GeneralInfo), nil
+}
+
 func handleGetDatabaseLastUpdate(collection *mongo.Collection) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
@@ -39,11 +54,11 @@ func handleGetDatabaseLastUpdate(collection *mongo.Collection) http.HandlerFunc
 		}
 
 		// Get general info
-		var generalInfo GeneralInfo
-		err := collection.FindOne(context.Background(), bson.M{}).Decode(&generalInfo)
+		generalInfo, err := getGeneralInfo(collection)
 		if err != nil {
 			log.Println("Error finding general info: " + err.Error())
 			http.Error(w, "Error while finding general info", http.StatusInternalServerError)
+			return
 		}
 
 		response := LastInfoUpdateResponse{
@@ -69,11 +84,11 @@ func handleGetIntroduction(collection *mongo.Collection) http.HandlerFunc {
 		}
 
 		// Get general info
-		var generalInfo GeneralInfo
-		err := collection.FindOne(context.Background(), bson.M{}).Decode(&generalInfo)
+		generalInfo, err := getGeneralInfo(collection)
 		if err != nil {
 			log.Println("Error finding general info: " + err.Error())
 			http.Error(w, "Error while finding general info", http.StatusInternalServerError)
+			return
 		}
 
 		response := IntroductionResponse{
@@ -100,11 +115,11 @@ func handleGetLastInfoUpdate(collection *mongo.Collection) http.HandlerFunc {
 		}
 
 		// Get general info
-		var generalInfo GeneralInfo
-		err := collection.FindOne(context.Background(), bson.M{}).Decode(&generalInfo)
+		generalInfo, err := getGeneralInfo(collection)
 		if err != nil {
 			log.Println("Error finding general info: " + err.Error())
 			http.Error(w, "Error while finding general info", http.StatusInternalServerError)
+			return
 		}
 
 		response := LastInfoUpdateResponse{
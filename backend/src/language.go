@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var SupportedLanguages = []string{"ko", "en"}
+
+type acceptedLanguage struct {
+	language string
+	quality  float64
+}
+
+// Get the language from lang param or Accept-Language header.
+// Falls back to the default language if none of them is supported.
+func getRequestLanguage(r *http.Request) string {
+	lang := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("lang")))
+	if slices.Contains(SupportedLanguages, lang) {
+		return lang
+	}
+
+	// e.g. "en-US,en;q=0.9,ko;q=0.8"
+	accepted := []acceptedLanguage{}
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		// Only the primary subtag is used ("en-US" -> "en")
+		language := strings.ToLower(strings.Split(fields[0], "-")[0])
+		if language == "" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					quality = q
+				}
+			}
+		}
+		accepted = append(accepted, acceptedLanguage{language: language, quality: quality})
+	}
+	sort.SliceStable(accepted, func(i, j int) bool {
+		return accepted[i].quality > accepted[j].quality
+	})
+
+	for _, item := range accepted {
+		if item.quality > 0 && slices.Contains(SupportedLanguages, item.language) {
+			return item.language
+		}
+	}
+	return DefaultLanguage
+}
@@ -7,13 +7,28 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// One document per like of a user
 type LikeDocument struct {
+	HospitalId string    `bson:"hospitalId"`
+	UserId     string    `bson:"userId"`
+	Timestamp  time.Time `bson:"timestamp"`
+}
+
+// Like count of a hospital, maintained on each like and unlike
+type LikeCountDocument struct {
+	HospitalId string `bson:"_id"`
+	Count      int    `bson:"count"`
+}
+
+// Shape of like documents before per-like documents, one document per hospital
+type LegacyLikeDocument struct {
 	HospitalId string   `bson:"hospitalId"`
 	UserIds    []string `bson:"userIds"` // User IDs who liked the hospital
 }
@@ -33,13 +48,13 @@ type LikeFoundResponse struct {
 }
 
 func getLikeCount(collection *mongo.Collection, hospitalId string) int {
-	if collection.Name() != LikeCollectionName {
+	if collection.Name() != LikeCountCollectionName {
 		log.Printf("Got wrong collection: %s", collection.Name())
 		return 0
 	}
 
-	var document LikeDocument
-	err := collection.FindOne(context.Background(), bson.M{"hospitalId": hospitalId}).Decode(&document)
+	var document LikeCountDocument
+	err := collection.FindOne(context.Background(), bson.M{"_id": hospitalId}).Decode(&document)
 
 	// There is a chance that the document doesn't exist
 	if err != nil && err != mongo.ErrNoDocuments {
@@ -47,45 +62,231 @@ func getLikeCount(collection *mongo.Collection, hospitalId string) int {
 		return 0
 	}
 
-	return len(document.UserIds)
+	return document.Count
 }
 
-func ensureLikeCollectionIndex(collection *mongo.Collection) bool {
-	if collection.Name() != LikeCollectionName {
+func updateLikeCount(ctx context.Context, collection *mongo.Collection, hospitalId string, delta int) bool {
+	if collection.Name() != LikeCountCollectionName {
 		log.Printf("Got wrong collection: %s", collection.Name())
 		return false
 	}
 
-	// Skip if collection is empty
-	totalCount, err := collection.CountDocuments(context.Background(), bson.M{})
-	if err != nil && err != mongo.ErrNoDocuments {
-		log.Println("Error in counting in ensureLikeCollectionIndex: " + err.Error())
+	_, err := collection.UpdateOne(ctx, bson.M{"_id": hospitalId},
+		bson.M{"$inc": bson.M{"count": delta}}, options.Update().SetUpsert(true))
+	if err != nil {
+		log.Println("Failed to update like count of " + hospitalId + ": " + err.Error())
+		return false
+	}
+	return true
+}
+
+// Add or remove the like of the user with its count, and returns true if it was changed
+func recordLike(ctx context.Context, likeCollection *mongo.Collection,
+	likeCountCollection *mongo.Collection,
+	hospitalId string, userId string, like bool) (bool, error) {
+	if likeCollection.Name() != LikeCollectionName {
+		return false, fmt.Errorf("got wrong collection: %s", likeCollection.Name())
+	}
+
+	filter := bson.M{"hospitalId": hospitalId, "userId": userId}
+	if like {
+		// Liking twice is no-op
+		update := bson.M{"$setOnInsert": LikeDocument{
+			HospitalId: hospitalId,
+			UserId:     userId,
+			Timestamp:  time.Now(),
+		}}
+		result, err := likeCollection.UpdateOne(ctx, filter, update,
+			options.Update().SetUpsert(true))
+		if err != nil || result.UpsertedCount == 0 {
+			return false, err
+		}
+		if !updateLikeCount(ctx, likeCountCollection, hospitalId, 1) {
+			return false, fmt.Errorf("failed to update like count of %s", hospitalId)
+		}
+		return true, nil
+	}
+
+	result, err := likeCollection.DeleteOne(ctx, filter)
+	if err != nil || result.DeletedCount == 0 {
+		return false, err
+	}
+	if !updateLikeCount(ctx, likeCountCollection, hospitalId, -1) {
+		return false, fmt.Errorf("failed to update like count of %s", hospitalId)
+	}
+	return true, nil
+}
+
+// Remove all likes of the user, and returns the number of unliked hospitals
+func removeAllLikes(likeCollection *mongo.Collection,
+	likeCountCollection *mongo.Collection, userId string) (int64, error) {
+	if likeCollection.Name() != LikeCollectionName {
+		return 0, fmt.Errorf("got wrong collection: %s", likeCollection.Name())
+	}
+
+	hospitalIds, err := likeCollection.Distinct(context.Background(), "hospitalId", bson.M{"userId": userId})
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	for _, value := range hospitalIds {
+		hospitalId, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var removed bool
+		err = runInTransaction(likeCollection.Database().Client(), func(ctx context.Context) error {
+			removed, err = recordLike(ctx, likeCollection, likeCountCollection, hospitalId, userId, false)
+			return err
+		})
+		if err != nil {
+			return count, err
+		}
+		if removed {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func ensureLikeCollectionIndex(collection *mongo.Collection) bool {
+	if collection.Name() != LikeCollectionName {
+		log.Printf("Got wrong collection: %s", collection.Name())
 		return false
-	} else if totalCount == 0 {
-		log.Println("Skip ensureLikeCollectionIndex as collection is empty")
-		return true
 	}
 
-	// Index model for hospital ID and user ID using bson.D for ordered keys
-	indexModel := mongo.IndexModel{
-		Keys: bson.D{
-			{Key: "hospitalId", Value: 1}, // 1 for ascending order
+	// Legacy documents without userId are excluded from the unique index until migrated
+	indexModels := []mongo.IndexModel{
+		{
+			Keys: bson.D{
+				{Key: "hospitalId", Value: 1}, // 1 for ascending order
+				{Key: "userId", Value: 1},
+			},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"userId": bson.M{"$exists": true}}),
+		},
+		{
+			Keys: bson.D{
+				{Key: "userId", Value: 1},
+			},
 		},
-		Options: options.Index().SetUnique(false),
 	}
 
 	// Create the index
-	_, err = collection.Indexes().CreateOne(context.Background(), indexModel)
+	_, err := collection.Indexes().CreateMany(context.Background(), indexModels)
 	if err != nil {
 		log.Println("Could not create index in like collection: " + err.Error())
-	} else {
-		log.Println("Like collection index created successfully")
+		return false
 	}
+	log.Println("Like collection index created successfully")
 	return true
 }
 
+// Split legacy documents into per-like documents, and returns the number of migrated hospitals.
+// Like counts should be rebuilt after migration.
+func migrateLikes(likeCollection *mongo.Collection) (int, error) {
+	if likeCollection.Name() != LikeCollectionName {
+		return 0, fmt.Errorf("got wrong collection: %s", likeCollection.Name())
+	}
+
+	cursor, err := likeCollection.Find(context.Background(), bson.M{"userIds": bson.M{"$exists": true}})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(context.Background())
+
+	count := 0
+	timestamp := time.Now()
+	for cursor.Next(context.Background()) {
+		var legacy struct {
+			Id                 any `bson:"_id"`
+			LegacyLikeDocument `bson:",inline"`
+		}
+		err = cursor.Decode(&legacy)
+		if err != nil {
+			log.Println("Like cursor decode error: " + err.Error())
+			continue
+		}
+
+		// Upsert, so that the migration can be resumed
+		models := []mongo.WriteModel{}
+		for _, userId := range legacy.UserIds {
+			models = append(models, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"hospitalId": legacy.HospitalId, "userId": userId}).
+				SetUpdate(bson.M{"$setOnInsert": LikeDocument{
+					HospitalId: legacy.HospitalId,
+					UserId:     userId,
+					Timestamp:  timestamp,
+				}}).
+				SetUpsert(true))
+		}
+		if len(models) > 0 {
+			_, err = likeCollection.BulkWrite(context.Background(), models)
+			if err != nil {
+				return count, err
+			}
+		}
+		_, err = likeCollection.DeleteOne(context.Background(), bson.M{"_id": legacy.Id})
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// Recount likes of all hospitals from like documents
+func rebuildLikeCounts(likeCollection *mongo.Collection, likeCountCollection *mongo.Collection) error {
+	if likeCollection.Name() != LikeCollectionName ||
+		likeCountCollection.Name() != LikeCountCollectionName {
+		return fmt.Errorf("wrong collection is assigned")
+	}
+
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.M{"userId": bson.M{"$exists": true}}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$hospitalId"},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+	}
+	cursor, err := likeCollection.Aggregate(context.Background(), pipeline)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	var counts []LikeCountDocument
+	if err = cursor.All(context.Background(), &counts); err != nil {
+		return err
+	}
+
+	hospitalIds := []string{}
+	models := []mongo.WriteModel{}
+	for _, document := range counts {
+		hospitalIds = append(hospitalIds, document.HospitalId)
+		models = append(models, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"_id": document.HospitalId}).
+			SetReplacement(document).
+			SetUpsert(true))
+	}
+	if len(models) > 0 {
+		_, err = likeCountCollection.BulkWrite(context.Background(), models)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Remove counts of hospitals without likes
+	_, err = likeCountCollection.DeleteMany(context.Background(),
+		bson.M{"_id": bson.M{"$nin": hospitalIds}})
+	return err
+}
+
 func handlePostLike(likeCollection *mongo.Collection,
-	userCollection *mongo.Collection) http.HandlerFunc {
+	likeCountCollection *mongo.Collection,
+	activityCollection *mongo.Collection) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
@@ -93,7 +294,8 @@ func handlePostLike(likeCollection *mongo.Collection,
 		}
 
 		if likeCollection.Name() != LikeCollectionName ||
-			userCollection.Name() != UserCollectionName {
+			likeCountCollection.Name() != LikeCountCollectionName ||
+			activityCollection.Name() != ActivityEventCollectionName {
 			log.Println("Wrong collection is assigned")
 			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
 			return
@@ -106,24 +308,19 @@ func handlePostLike(likeCollection *mongo.Collection,
 			log.Println("Failed to decode like post request: " + err.Error())
 			return
 		}
-
-		// Define the filter
-		filter := bson.M{"hospitalId": likeReq.HospitalId}
-		update := bson.M{}
-		opts := options.UpdateOptions{}
-
-		like := likeReq.Like != 0
-		if like {
-			// Like
-			update = bson.M{"$addToSet": bson.M{"userIds": likeReq.UserId}}
-			// Create document if it doesn't exist
-			opts = *options.Update().SetUpsert(true)
-		} else {
-			// Unlike
-			update = bson.M{"$pull": bson.M{"userIds": likeReq.UserId}}
+		if likeReq.HospitalId == "" || likeReq.UserId == "" {
+			http.Error(w, "hospitalId or userId is empty", http.StatusBadRequest)
+			return
 		}
 
-		_, err = likeCollection.UpdateOne(context.Background(), filter, update, &opts)
+		// The like and the like count are written together
+		like := likeReq.Like != 0
+		changed := false
+		err = runInTransaction(likeCollection.Database().Client(), func(ctx context.Context) error {
+			var err error
+			changed, err = recordLike(ctx, likeCollection, likeCountCollection, likeReq.HospitalId, likeReq.UserId, like)
+			return err
+		})
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			log.Println("Failed to add like " + strconv.Itoa(likeReq.Like) +
@@ -132,8 +329,14 @@ func handlePostLike(likeCollection *mongo.Collection,
 			return
 		}
 
-		// Record user activity
-		recordUserLike(userCollection, likeReq.UserId, likeReq.HospitalId, like)
+		// Liking twice is not an activity
+		if changed {
+			eventType := ActivityTypeUnlike
+			if like {
+				eventType = ActivityTypeLike
+			}
+			recordActivityEvent(activityCollection, likeReq.HospitalId, likeReq.UserId, eventType)
+		}
 
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		fmt.Fprintf(w, "Like submitted")
@@ -147,7 +350,7 @@ func handleGetLikeCount(collection *mongo.Collection) http.HandlerFunc {
 			return
 		}
 
-		if collection.Name() != LikeCollectionName {
+		if collection.Name() != LikeCountCollectionName {
 			log.Printf("Got wrong collection: %s", collection.Name())
 			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
 			return
@@ -194,27 +397,18 @@ func handleGetLikeFound(collection *mongo.Collection) http.HandlerFunc {
 			return
 		}
 
-		var document LikeDocument
-		err := collection.FindOne(context.Background(), bson.M{"hospitalId": hospitalId}).Decode(&document)
-
-		// There is a chance that the document doesn't exist
-		if err != nil && err != mongo.ErrNoDocuments {
+		count, err := collection.CountDocuments(context.Background(),
+			bson.M{"hospitalId": hospitalId, "userId": userId}, options.Count().SetLimit(1))
+		if err != nil {
 			log.Println("Error while finding like: " + err.Error())
 			http.Error(w, "Error while finding like", http.StatusInternalServerError)
 			return
 		}
 
-		// Check if userId is in the likes array
+		// Respond with the like found
 		response := LikeFoundResponse{
-			Found: 0,
-		}
-		for _, id := range document.UserIds {
-			if id == userId {
-				response.Found = 1
-			}
+			Found: int(count),
 		}
-
-		// Respond with the like found
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
 	}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -22,6 +24,27 @@ func checkCollectionExists(db *mongo.Database, collectionName string) bool {
 }
 
 func main() {
+	command := flag.String("command", "", fmt.Sprintf("run a maintenance command instead of the server: %v", CommandNames))
+	authMode := flag.String("auth-mode", AuthModeLegacy, fmt.Sprintf("device token requirement: %s or %s",
+		AuthModeLegacy, AuthModeStrict))
+	trustedProxies := flag.String("trusted-proxies", "",
+		"comma separated IPs or CIDRs of reverse proxies whose forwarded client IPs are trusted")
+	adminName := flag.String("admin-name", "", fmt.Sprintf("name of the admin for %s and %s commands",
+		CommandAddAdminKey, CommandRemoveAdminKey))
+	flag.Parse()
+	if *authMode != AuthModeLegacy && *authMode != AuthModeStrict {
+		log.Printf("Unknown auth mode: %s", *authMode)
+		return
+	}
+	_authMode = *authMode
+	_commandAdminName = *adminName
+	proxies, err := parseTrustedProxies(*trustedProxies)
+	if err != nil {
+		log.Printf("Bad trusted proxies: %s", *trustedProxies)
+		return
+	}
+	_trustedProxies = proxies
+
 	// Set timezone
 	location, err := time.LoadLocation("Asia/Seoul")
 	if err != nil {
@@ -34,7 +57,26 @@ func main() {
 	startProfiler([]string{
 		ProfileKeyGetHospitals,
 		ProfileKeyGetMoonlights,
-		ProfileKeyGetSurveySummary})
+		ProfileKeyGetSurveySummary,
+		ProfileKeyGetSurveySummaries,
+		ProfileKeyGetTrending})
+
+	// Init rate limiter
+	startRateLimiter(map[string]rateLimitBudget{
+		RateLimitKeyLike:             {requests: RateLimitLikeRequests, period: RateLimitPeriod},
+		RateLimitKeySurveySubmit:     {requests: RateLimitSurveySubmitRequests, period: RateLimitPeriod},
+		RateLimitKeyAnnouncementPost: {requests: RateLimitAnnouncementRequests, period: RateLimitPeriod},
+		RateLimitKeyTransfer:         {requests: RateLimitTransferRequests, period: RateLimitPeriod}})
+
+	// Init reference document cache
+	startCache([]string{
+		CacheKeyHoliday,
+		CacheKeyGeneralInfo,
+		CacheKeySurveyQuestionnaire,
+		CacheKeyScoreModel,
+		CacheKeyAuthKeys,
+		CacheKeyAdminKeys},
+		ReferenceCacheTtl)
 
 	// MongoDB connection setup
 	clientOptions := options.Client().ApplyURI(MongoUri)
@@ -46,6 +88,15 @@ func main() {
 
 	// MongoDB collections
 	db := client.Database(HospitalDatabaseName)
+	detectTransactionSupport(client)
+
+	// Run command and exit
+	if *command != "" {
+		if !runCommand(*command, db) {
+			os.Exit(1)
+		}
+		return
+	}
 
 	infoCollection := db.Collection(InfoCollectionName)
 	hospitalCollection := db.Collection(HospitalCollectionName)
@@ -53,17 +104,96 @@ func main() {
 	holidayCollection := db.Collection(HolidayCollectionName)
 	surveyCollection := db.Collection(SurveyCollectionName)
 	likeCollection := db.Collection(LikeCollectionName)
+	likeCountCollection := db.Collection(LikeCountCollectionName)
 	userCollection := db.Collection(UserCollectionName)
 	announcementCollection := db.Collection(AnnouncementCollectionName)
+	surveyQuestionCollection := db.Collection(SurveyQuestionCollectionName)
+	surveyTipCollection := db.Collection(SurveyTipCollectionName)
+	surveySummaryCollection := db.Collection(SurveySummaryCollectionName)
+	settingCollection := db.Collection(SettingCollectionName)
+	surveyReportCollection := db.Collection(SurveyReportCollectionName)
+	moderationLogCollection := db.Collection(ModerationLogCollectionName)
+	surveyVoteCollection := db.Collection(SurveyVoteCollectionName)
+	waitingReportCollection := db.Collection(WaitingReportCollectionName)
+	busynessProfileCollection := db.Collection(BusynessProfileCollectionName)
+	activityEventCollection := db.Collection(ActivityEventCollectionName)
+	favoriteListCollection := db.Collection(FavoriteListCollectionName)
+	deviceCollection := db.Collection(DeviceCollectionName)
+	transferCodeCollection := db.Collection(TransferCodeCollectionName)
 
 	if checkCollectionExists(db, SurveyCollectionName) &&
 		!ensureSurveyCollectionIndex(surveyCollection) {
 		return
 	}
-	if checkCollectionExists(db, LikeCollectionName) &&
-		!ensureLikeCollectionIndex(likeCollection) {
+	if !migrateSurveyTimestamps(surveyCollection) {
+		return
+	}
+	if !ensureLikeCollectionIndex(likeCollection) {
+		return
+	}
+	if count, err := migrateLikes(likeCollection); err != nil {
+		log.Println("Failed to migrate likes: " + err.Error())
+		return
+	} else if count > 0 || !checkCollectionExists(db, LikeCountCollectionName) {
+		if err = rebuildLikeCounts(likeCollection, likeCountCollection); err != nil {
+			log.Println("Failed to rebuild like counts: " + err.Error())
+		}
+	}
+	if !ensureSurveyQuestionCollection(surveyQuestionCollection) {
+		return
+	}
+	if !ensureSurveyTipCollectionIndex(surveyTipCollection) {
+		return
+	}
+	if !ensureSurveyReportCollectionIndex(surveyReportCollection) {
 		return
 	}
+	if !ensureSurveyVoteCollectionIndex(surveyVoteCollection) {
+		return
+	}
+	if !ensureWaitingReportCollectionIndex(waitingReportCollection) {
+		return
+	}
+	if !ensureActivityEventCollectionIndex(activityEventCollection) {
+		return
+	}
+	if !ensureFavoriteListCollectionIndex(favoriteListCollection) {
+		return
+	}
+	if !ensureTransferCodeCollectionIndex(transferCodeCollection) {
+		return
+	}
+	if !ensureHospitalCollectionIndex(hospitalCollection) {
+		return
+	}
+	if !rotateAuthKeys(settingCollection) {
+		return
+	}
+	if questionnaire, err := getLatestSurveyQuestionnaire(surveyQuestionCollection); err != nil ||
+		!backfillSurveyTips(surveyTipCollection, surveyCollection, questionnaire) {
+		log.Println("Failed to backfill survey tips")
+	}
+	if checkCollectionExists(db, SurveyCollectionName) &&
+		!checkCollectionExists(db, SurveySummaryCollectionName) &&
+		!runCommand(CommandRebuildSurveySummaries, db) {
+		log.Println("Failed to build initial survey summaries")
+	}
+	if count, err := backfillSurveySummaryWeights(surveyCollection, surveySummaryCollection); err != nil {
+		log.Println("Failed to backfill survey summary weights: " + err.Error())
+		return
+	} else if count > 0 {
+		log.Printf("Backfilled weights of %d survey summaries", count)
+	}
+
+	// Start background jobs
+	startScoreRefresher(hospitalCollection, surveySummaryCollection, settingCollection)
+	startBusynessRefresher(waitingReportCollection, surveyCollection, busynessProfileCollection)
+	startTrustRefresher(userCollection, surveyCollection, surveySummaryCollection,
+		likeCollection, surveyReportCollection, deviceCollection, settingCollection)
+	startAuthKeyRotator(settingCollection)
+
+	// Device
+	http.HandleFunc("/v1/device/register", handlePostDeviceRegister(deviceCollection, settingCollection, userCollection, likeCollection))
 
 	// Info
 	http.HandleFunc("/v1/database/last-update", handleGetDatabaseLastUpdate(infoCollection))
@@ -72,35 +202,146 @@ func main() {
 
 	// Hospital
 	http.HandleFunc("/v1/hospital", handleGetHospital(
-		hospitalCollection, holidayCollection, surveyCollection, likeCollection))
+		hospitalCollection, holidayCollection, surveyCollection, likeCountCollection,
+		surveySummaryCollection, settingCollection, waitingReportCollection))
 	http.HandleFunc("/v1/hospitals", handleGetFilteredHospitals(
-		hospitalCollection, holidayCollection, surveyCollection, likeCollection))
+		hospitalCollection, holidayCollection, surveyCollection, likeCountCollection,
+		surveySummaryCollection, settingCollection, waitingReportCollection))
+	http.HandleFunc("/v1/hospitals/trending", handleGetTrendingHospitals(activityEventCollection,
+		hospitalCollection, holidayCollection, surveyCollection, likeCountCollection,
+		surveySummaryCollection, settingCollection, waitingReportCollection))
+	http.HandleFunc("/v1/hospital/busyness", handleGetBusynessProfile(busynessProfileCollection))
 	http.HandleFunc("/v1/moonlights", handleGetAllMoonlights(
-		moonlightCollection, holidayCollection, surveyCollection, likeCollection))
+		moonlightCollection, holidayCollection, surveyCollection, likeCountCollection,
+		surveySummaryCollection, settingCollection, waitingReportCollection))
+
+	// Score
+	http.HandleFunc("/v1/score/model", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			withAdmin(settingCollection, "",
+				handlePostScoreModel(hospitalCollection, surveySummaryCollection, settingCollection))(w, r)
+		} else {
+			handleGetScoreModel(settingCollection)(w, r)
+		}
+	})
 
 	// Survey
-	http.HandleFunc("/v1/survey/questions", handleGetSurveyQuestions())
-	http.HandleFunc("/v1/survey/answer", handleGetSurveyAnswer(surveyCollection))
-	http.HandleFunc("/v1/survey/summary", handleGetSurveySummary(surveyCollection))
-	http.HandleFunc("/v1/survey/submit", handlePostSurveyAnswer(surveyCollection, userCollection))
+	http.HandleFunc("/v1/survey/questions", handleGetSurveyQuestions(surveyQuestionCollection))
+	http.HandleFunc("/v1/survey/questionnaire", withAdmin(settingCollection, "",
+		handlePostSurveyQuestionnaire(surveyQuestionCollection)))
+	http.HandleFunc("/v1/survey/answer", withDeviceUser(settingCollection, "userId",
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodDelete {
+				handleDeleteSurveyAnswer(surveyCollection, userCollection,
+					surveyTipCollection, surveySummaryCollection)(w, r)
+			} else {
+				handleGetSurveyAnswer(surveyCollection)(w, r)
+			}
+		}))
+	http.HandleFunc("/v1/survey/summary", handleGetSurveySummary(
+		surveyCollection, surveySummaryCollection, surveyQuestionCollection, surveyTipCollection))
+	http.HandleFunc("/v1/survey/summaries", handlePostSurveySummaries(
+		surveyCollection, surveySummaryCollection, surveyQuestionCollection))
+	http.HandleFunc("/v1/survey/trend", handleGetSurveyTrend(surveyCollection, surveyQuestionCollection))
+	http.HandleFunc("/v1/survey/submit", withDeviceUser(settingCollection, "userId",
+		withRateLimit(RateLimitKeySurveySubmit, handlePostSurveyAnswer(
+			surveyCollection, userCollection, hospitalCollection,
+			surveyQuestionCollection, surveyTipCollection, surveySummaryCollection, activityEventCollection))))
+	http.HandleFunc("/v1/survey/tips", handleGetSurveyTips(surveyTipCollection))
+	http.HandleFunc("/v1/survey/tips/moderation", withAdmin(settingCollection, "",
+		handleGetSurveyTipsForModeration(surveyTipCollection)))
+	http.HandleFunc("/v1/survey/tip/moderate", withAdmin(settingCollection, "",
+		handlePostSurveyTipModeration(surveyTipCollection)))
+	http.HandleFunc("/v1/survey/report", withDeviceUser(settingCollection, "reporterId",
+		handlePostSurveyReport(surveyCollection, surveyTipCollection, surveySummaryCollection,
+			surveyReportCollection, moderationLogCollection)))
+	http.HandleFunc("/v1/survey/reports", withAdmin(settingCollection, "",
+		handleGetSurveyReports(surveyReportCollection)))
+	http.HandleFunc("/v1/survey/report/resolve", withAdmin(settingCollection, "moderatorId",
+		handlePostSurveyReportResolve(surveyCollection, surveyTipCollection, surveySummaryCollection,
+			surveyReportCollection, moderationLogCollection)))
+	http.HandleFunc("/v1/survey/vote", withDeviceUser(settingCollection, "voterId",
+		handlePostSurveyVote(surveyVoteCollection, surveyTipCollection)))
+	http.HandleFunc("/v1/survey/vote/found", withDeviceUser(settingCollection, "voterId",
+		handleGetSurveyVoteFound(surveyVoteCollection, surveyTipCollection)))
+	http.HandleFunc("/v1/moderation/logs", withAdmin(settingCollection, "",
+		handleGetModerationLogs(moderationLogCollection)))
+
+	// Waiting
+	http.HandleFunc("/v1/waiting/report", withDeviceUser(settingCollection, "userId",
+		handlePostWaitingReport(waitingReportCollection, hospitalCollection)))
 
 	// Like
-	http.HandleFunc("/v1/like", handlePostLike(likeCollection, userCollection))
-	http.HandleFunc("/v1/like/count", handleGetLikeCount(likeCollection))
-	http.HandleFunc("/v1/like/found", handleGetLikeFound(likeCollection))
+	http.HandleFunc("/v1/like", withDeviceUser(settingCollection, "userId",
+		withRateLimit(RateLimitKeyLike,
+			handlePostLike(likeCollection, likeCountCollection, activityEventCollection))))
+	http.HandleFunc("/v1/like/count", handleGetLikeCount(likeCountCollection))
+	http.HandleFunc("/v1/like/found", withDeviceUser(settingCollection, "userId", handleGetLikeFound(likeCollection)))
 
 	// User
-	http.HandleFunc("/v1/user/survey/count", handleGetUserSurveyCount(userCollection))
+	http.HandleFunc("/v1/user/survey/count", withDeviceUser(settingCollection, "userId",
+		handleGetUserSurveyCount(userCollection)))
+	http.HandleFunc("/v1/user/data", withRequiredDeviceUser(settingCollection, deviceCollection, "userId",
+		handleDeleteUserData(surveyCollection, likeCollection, likeCountCollection, userCollection,
+			surveyTipCollection, surveySummaryCollection, surveyVoteCollection,
+			waitingReportCollection, activityEventCollection, favoriteListCollection,
+			surveyReportCollection, deviceCollection, transferCodeCollection)))
+	http.HandleFunc("/v1/user/export", withRequiredDeviceUser(settingCollection, deviceCollection, "userId",
+		handleGetUserDataExport(userCollection, deviceCollection, surveyCollection, surveyTipCollection,
+			likeCollection, surveyReportCollection, moderationLogCollection, surveyVoteCollection,
+			waitingReportCollection, activityEventCollection, favoriteListCollection,
+			hospitalCollection, moonlightCollection)))
+	http.HandleFunc("/v1/user/transfer/code", withRequiredDeviceUser(settingCollection, deviceCollection, "userId",
+		handlePostTransferCode(transferCodeCollection)))
+	http.HandleFunc("/v1/user/transfer", withRequiredDeviceUser(settingCollection, deviceCollection, "userId",
+		withRateLimit(RateLimitKeyTransfer, handlePostTransfer(transferCodeCollection, userCollection,
+			likeCollection, likeCountCollection, surveyCollection, surveyTipCollection, surveySummaryCollection,
+			surveyVoteCollection, favoriteListCollection, waitingReportCollection, activityEventCollection,
+			surveyReportCollection))))
+
+	// Favorite list
+	http.HandleFunc("/v1/lists", withDeviceUser(settingCollection, "userId",
+		handleGetFavoriteLists(favoriteListCollection)))
+	http.HandleFunc("/v1/list", withDeviceUser(settingCollection, "userId",
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodDelete {
+				handleDeleteFavoriteList(favoriteListCollection)(w, r)
+			} else {
+				handlePostFavoriteList(favoriteListCollection, hospitalCollection)(w, r)
+			}
+		}))
+	http.HandleFunc("/v1/list/share", withDeviceUser(settingCollection, "userId",
+		handlePostFavoriteListShare(favoriteListCollection)))
+	http.HandleFunc("/v1/list/shared", handleGetSharedFavoriteList(favoriteListCollection,
+		hospitalCollection, holidayCollection, surveyCollection, likeCountCollection,
+		surveySummaryCollection, settingCollection, waitingReportCollection))
 
 	// Announcement
 	http.HandleFunc("/v1/announcements", handleGetAnnouncements(announcementCollection))
 	http.HandleFunc("/v1/announcements/last-update", handleGetAnnouncementsLastUpdate(announcementCollection))
-	http.HandleFunc("/v1/announcement/post", handlePostAnnouncement(announcementCollection))
+	http.HandleFunc("/v1/announcement/post", withRateLimit(RateLimitKeyAnnouncementPost,
+		handlePostAnnouncement(announcementCollection)))
 	http.HandleFunc("/v1/announcement/delete", handleDeleteAnnouncement(announcementCollection))
 
 	// Holiday
 	http.HandleFunc("/v1/holiday/today", handleGetIsTodayHoliday(holidayCollection))
 
+	// Cache
+	http.HandleFunc("/v1/cache/invalidate", withAdmin(settingCollection, "",
+		func(w http.ResponseWriter, r *http.Request) {
+			handlePostCacheInvalidate()(w, r)
+
+			// Pushed hospitals have no scores until they are refreshed
+			if r.Method != http.MethodPost {
+				return
+			}
+			go func() {
+				if err := refreshScores(hospitalCollection, surveySummaryCollection, settingCollection); err != nil {
+					log.Println("Failed to refresh scores: " + err.Error())
+				}
+			}()
+		}))
+
 	log.Printf("Server is running on port %d...", DefaultPort)
 	log.Print(http.ListenAndServe(fmt.Sprintf(":%d", DefaultPort), nil))
 }
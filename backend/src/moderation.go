@@ -0,0 +1,81 @@
+package main
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+type ModerationResult struct {
+	Text  string
+	State string // "pending", "approved", "rejected"
+}
+
+// Words that reject a text right away. Matched on word boundaries,
+// so that ordinary words containing them (e.g. 시발점) are not rejected.
+var BannedWords = []string{
+	"시발", "씨발", "씨바", "병신", "븅신", "개새끼", "개새", "좆", "존나", "졸라",
+	"미친놈", "미친년", "꺼져", "닥쳐", "지랄", "엿먹",
+	"fuck", "fucking", "shit", "bitch",
+}
+
+// Particles and endings attached to banned words, e.g. 병신아, 지랄하네
+var BannedWordSuffixes = []string{
+	"아", "야", "이", "이야", "은", "는", "가", "을", "를", "들", "도", "같은", "같이",
+	"하네", "하지", "하고", "해", "었", "어", "라", "s",
+}
+
+var _piiPatterns = []*regexp.Regexp{
+	// Phone numbers (e.g. 010-1234-5678, 02 123 4567, +82 10 1234 5678)
+	regexp.MustCompile(`(\+82[-. ]?|0)\d{1,2}[-. ]?\d{3,4}[-. ]?\d{4}`),
+	// Resident registration numbers
+	regexp.MustCompile(`\d{6}[-. ]?[1-4]\d{6}`),
+	// Emails
+	regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`),
+}
+
+func containsBannedWord(text string) bool {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for _, word := range words {
+		for _, banned := range BannedWords {
+			if !strings.HasPrefix(word, banned) {
+				continue
+			}
+			suffix := strings.TrimPrefix(word, banned)
+			if suffix == "" || slices.Contains(BannedWordSuffixes, suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func stripPersonalInfo(text string) (string, bool) {
+	stripped := false
+	for _, pattern := range _piiPatterns {
+		if pattern.MatchString(text) {
+			text = pattern.ReplaceAllString(text, PiiReplacement)
+			stripped = true
+		}
+	}
+	return text, stripped
+}
+
+// Run the moderation pipeline for a user text.
+// Texts with banned words are rejected, texts with personal info are stripped and
+// left for a manual review, and the others are approved.
+func moderateText(text string) ModerationResult {
+	text = strings.TrimSpace(text)
+	if containsBannedWord(text) {
+		return ModerationResult{Text: text, State: "rejected"}
+	}
+
+	text, stripped := stripPersonalInfo(text)
+	if stripped {
+		return ModerationResult{Text: text, State: "pending"}
+	}
+	return ModerationResult{Text: text, State: "approved"}
+}
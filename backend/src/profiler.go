@@ -68,5 +68,8 @@ func _logProfileSummary() {
 
 			profile.mutex.Unlock()
 		}
+
+		logCacheSummary()
+		logRateLimitSummary()
 	}
 }
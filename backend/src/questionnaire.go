@@ -0,0 +1,701 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type SurveyQuestionLabel struct {
+	Title       string            `bson:"title" json:"title"`
+	Description string            `bson:"description" json:"description"`
+	Options     map[string]string `bson:"options,omitempty" json:"options,omitempty"` // Overrides shared option labels
+}
+
+// Condition to ask a question, depending on the answer of a previous selection question
+type SurveyQuestionCondition struct {
+	Question string   `bson:"question" json:"question"`
+	Options  []string `bson:"options" json:"options"` // Asked if one of the options is selected
+}
+
+type SurveyQuestion struct {
+	Type          string                         `bson:"type" json:"type"` // "selection", "text"
+	Section       string                         `bson:"section" json:"section"`
+	Order         int                            `bson:"order" json:"order"`
+	State         string                         `bson:"state" json:"state"` // "active", "retired"
+	Options       []string                       `bson:"options" json:"options"`
+	MaxTextLength int                            `bson:"maxTextLength" json:"maxTextLength"`
+	Labels        map[string]SurveyQuestionLabel `bson:"labels" json:"labels,omitempty"` // Keys: language
+	ShowIf        *SurveyQuestionCondition       `bson:"showIf,omitempty" json:"showIf,omitempty"`
+}
+
+// Each questionnaire version is an immutable snapshot,
+// so that old answers keep the meaning of the version they answered
+type SurveyQuestionnaireDocument struct {
+	Version       int                          `bson:"version" json:"version"`
+	Timestamp     string                       `bson:"timestamp" json:"timestamp"`
+	Sections      []string                     `bson:"sections" json:"sections"`
+	SectionLabels map[string]map[string]string `bson:"sectionLabels" json:"sectionLabels"` // Language -> section -> label
+	OptionLabels  map[string]map[string]string `bson:"optionLabels" json:"optionLabels"`   // Language -> option -> label
+	Questions     map[string]SurveyQuestion    `bson:"questions" json:"questions"`
+}
+
+type SurveyQuestionnairePostRequest struct {
+	Sections      []string                     `json:"sections"`
+	SectionLabels map[string]map[string]string `json:"sectionLabels"`
+	OptionLabels  map[string]map[string]string `json:"optionLabels"`
+	Questions     map[string]SurveyQuestion    `json:"questions"`
+}
+
+type LocalizedSurveyQuestion struct {
+	SurveyQuestion
+	Title        string   `json:"title"`
+	Description  string   `json:"description"`
+	OptionLabels []string `json:"optionLabels"` // Same order as options
+}
+
+type SurveyQuestionsResponse struct {
+	Version       int                                `json:"version"`
+	Language      string                             `json:"language"`
+	Sections      []string                           `json:"sections"`
+	SectionLabels map[string]string                  `json:"sectionLabels"`
+	Questions     map[string]LocalizedSurveyQuestion `json:"questions"`
+}
+
+type SurveyQuestionnairePostResponse struct {
+	Version int `json:"version"`
+}
+
+// Seed of the first questionnaire version
+var DefaultSurveyQuestionnaire = SurveyQuestionnaireDocument{
+	Version:  1,
+	Sections: []string{"Space", "Treatment", "Checkup"},
+	SectionLabels: map[string]map[string]string{
+		"ko": {"Space": "공간", "Treatment": "진료 / 치료 / 처방", "Checkup": "영유아 검진"},
+		"en": {"Space": "Space", "Treatment": "Treatment / Prescription", "Checkup": "Infant checkup"},
+	},
+	OptionLabels: map[string]map[string]string{
+		"ko": {
+			"smallSpace": "아담해요", "average": "보통이에요", "bigSpace": "넓어요",
+			"easy": "편해요", "hard": "어려워요",
+			"clean": "청결해요", "kind": "친절해요", "thorough": "꼼꼼해요", "no": "아니에요",
+			"weak": "약해요", "strong": "강해요",
+			"do": "해요", "dont": "안해요",
+			"littleSick": "조금 아플때", "verySick": "많이 아플때",
+			"below1day": "당일 바로", "below7day": "일주일 이내", "over7day": "일주일 이상",
+			"below15min": "15분 이내", "below30min": "30분 이내", "below60min": "1시간 이내", "over60min": "1시간 이상",
+		},
+		"en": {
+			"smallSpace": "Small", "average": "Average", "bigSpace": "Spacious",
+			"easy": "Easy", "hard": "Difficult",
+			"clean": "Clean", "kind": "Kind", "thorough": "Thorough", "no": "Not really",
+			"weak": "Mild", "strong": "Strong",
+			"do": "Yes", "dont": "No",
+			"littleSick": "When a little sick", "verySick": "When very sick",
+			"below1day": "Same day", "below7day": "Within a week", "over7day": "Over a week",
+			"below15min": "Under 15 min", "below30min": "Under 30 min", "below60min": "Under 1 hour", "over60min": "Over 1 hour",
+		},
+	},
+	Questions: map[string]SurveyQuestion{
+		// Space
+		"waitingSpace": {
+			Type:    "selection",
+			Section: "Space",
+			Order:   1,
+			State:   "active",
+			Options: []string{
+				"smallSpace", "average", "bigSpace",
+			},
+			Labels: map[string]SurveyQuestionLabel{
+				"ko": {Title: "대기 공간", Description: "진료 대기 공간 크기는 어떤가요?"},
+				"en": {Title: "Waiting space", Description: "How big is the waiting area?"},
+			},
+		},
+		"parkingDifficulty": {
+			Type:    "selection",
+			Section: "Space",
+			Order:   2,
+			State:   "active",
+			Options: []string{
+				"easy", "hard",
+			},
+			Labels: map[string]SurveyQuestionLabel{
+				"ko": {Title: "주차", Description: "주차는 어떤가요?"},
+				"en": {Title: "Parking", Description: "How is parking?"},
+			},
+		},
+		"cleanliness": {
+			Type:    "selection",
+			Section: "Space",
+			Order:   3,
+			State:   "active",
+			Options: []string{
+				"clean", "average", "no",
+			},
+			Labels: map[string]SurveyQuestionLabel{
+				"ko": {Title: "청결", Description: "공간이 청결한 편인가요?"},
+				"en": {Title: "Cleanliness", Description: "Is the clinic clean?"},
+			},
+		},
+		// Treatment
+		"kindness": {
+			Type:    "selection",
+			Section: "Treatment",
+			Order:   1,
+			State:   "active",
+			Options: []string{
+				"kind", "average", "no",
+			},
+			Labels: map[string]SurveyQuestionLabel{
+				"ko": {Title: "친절", Description: "친절한 편인가요?"},
+				"en": {Title: "Kindness", Description: "Are the staff kind?"},
+			},
+		},
+		"thoroughness": {
+			Type:    "selection",
+			Section: "Treatment",
+			Order:   2,
+			State:   "active",
+			Options: []string{
+				"thorough", "average", "no",
+			},
+			Labels: map[string]SurveyQuestionLabel{
+				"ko": {Title: "꼼꼼함", Description: "진료가 꼼꼼한 편인가요?"},
+				"en": {Title: "Thoroughness", Description: "Is the examination thorough?"},
+			},
+		},
+		"medicineStrength": {
+			Type:    "selection",
+			Section: "Treatment",
+			Order:   3,
+			State:   "active",
+			Options: []string{
+				"weak", "average", "strong",
+			},
+			Labels: map[string]SurveyQuestionLabel{
+				"ko": {Title: "처방약 세기", Description: "처방약 세기는 어느 정도인가요?"},
+				"en": {Title: "Medicine strength", Description: "How strong are the prescriptions?"},
+			},
+		},
+		"ivTreatment": {
+			Type:    "selection",
+			Section: "Treatment",
+			Order:   4,
+			State:   "active",
+			Options: []string{
+				"do", "dont",
+			},
+			Labels: map[string]SurveyQuestionLabel{
+				"ko": {Title: "수액 치료", Description: "영유아 수액 치료를 하나요?"},
+				"en": {Title: "IV treatment", Description: "Do they give IV fluids to infants?"},
+			},
+		},
+		"whenToVisit": {
+			Type:    "selection",
+			Section: "Treatment",
+			Order:   5,
+			State:   "active",
+			Options: []string{
+				"littleSick", "verySick",
+			},
+			Labels: map[string]SurveyQuestionLabel{
+				"ko": {Title: "방문 시기", Description: "언제 가기 좋은가요?"},
+				"en": {Title: "When to visit", Description: "When is it good to visit?"},
+			},
+		},
+		"tipForVisitors": {
+			Type:          "text",
+			Section:       "Treatment",
+			Order:         6,
+			State:         "active",
+			MaxTextLength: 20,
+			Labels: map[string]SurveyQuestionLabel{
+				"ko": {Title: "방문 팁", Description: "방문하실 분들께 팁을 남겨주세요."},
+				"en": {Title: "Tip for visitors", Description: "Leave a tip for other visitors."},
+			},
+		},
+		// Checkup
+		"checkupAvailable": {
+			Type:    "selection",
+			Section: "Checkup",
+			Order:   1,
+			State:   "active",
+			Options: []string{
+				"do", "dont",
+			},
+			Labels: map[string]SurveyQuestionLabel{
+				"ko": {Title: "영유아 검진", Description: "영유아 검진을 하나요?"},
+				"en": {Title: "Infant checkup", Description: "Do they offer infant checkups?"},
+			},
+		},
+		"checkupWaiting": {
+			Type:    "selection",
+			Section: "Checkup",
+			Order:   2,
+			State:   "active",
+			Options: []string{
+				"below1day", "below7day", "over7day",
+			},
+			ShowIf: &SurveyQuestionCondition{Question: "checkupAvailable", Options: []string{"do"}},
+			Labels: map[string]SurveyQuestionLabel{
+				"ko": {Title: "검진 대기 기간", Description: "검진 대기 기간은 어느 정도인가요?"},
+				"en": {Title: "Checkup waiting", Description: "How long is the wait for a checkup?"},
+			},
+		},
+		// Retired
+		"morningWaiting": {
+			Type:    "selection",
+			Section: "Treatment",
+			Order:   100,
+			State:   "retired",
+			Options: []string{
+				"below15min", "below30min", "below60min", "over60min",
+			},
+			Labels: map[string]SurveyQuestionLabel{
+				"ko": {Title: "오전 대기 시간", Description: "오전 대기 시간은 어느 정도인가요?"},
+				"en": {Title: "Morning waiting", Description: "How long is the wait in the morning?"},
+			},
+		},
+		"afternoonWaiting": {
+			Type:    "selection",
+			Section: "Treatment",
+			Order:   101,
+			State:   "retired",
+			Options: []string{
+				"below15min", "below30min", "below60min", "over60min",
+			},
+			Labels: map[string]SurveyQuestionLabel{
+				"ko": {Title: "오후 대기 시간", Description: "오후 대기 시간은 어느 정도인가요?"},
+				"en": {Title: "Afternoon waiting", Description: "How long is the wait in the afternoon?"},
+			},
+		},
+	},
+}
+
+func (questionnaire SurveyQuestionnaireDocument) activeQuestions() map[string]SurveyQuestion {
+	questions := map[string]SurveyQuestion{}
+	for key, question := range questionnaire.Questions {
+		if question.State == "active" {
+			questions[key] = question
+		}
+	}
+	return questions
+}
+
+// Check if the question should be answered with the given answers,
+// following conditions of the condition questions as well
+func (questionnaire SurveyQuestionnaireDocument) isApplicable(key string,
+	answers map[string]SurveyAnswer) bool {
+	condition := questionnaire.Questions[key].ShowIf
+	if condition == nil {
+		return true
+	}
+	answer, ok := answers[condition.Question]
+	if !ok || !slices.Contains(condition.Options, answer.Option) {
+		return false
+	}
+	return questionnaire.isApplicable(condition.Question, answers)
+}
+
+// Get the option label of the language,
+// falling back to the default language and then the option key itself
+func (questionnaire SurveyQuestionnaireDocument) optionLabel(question SurveyQuestion,
+	option string, language string) string {
+	for _, lang := range []string{language, DefaultLanguage} {
+		if label, ok := question.Labels[lang].Options[option]; ok {
+			return label
+		}
+		if label, ok := questionnaire.OptionLabels[lang][option]; ok {
+			return label
+		}
+	}
+	return option
+}
+
+func (questionnaire SurveyQuestionnaireDocument) localizeQuestion(key string,
+	question SurveyQuestion, language string) LocalizedSurveyQuestion {
+	label, ok := question.Labels[language]
+	if !ok {
+		label = question.Labels[DefaultLanguage]
+	}
+
+	localized := LocalizedSurveyQuestion{
+		SurveyQuestion: question,
+		Title:          label.Title,
+		Description:    label.Description,
+		OptionLabels:   []string{},
+	}
+	// Labels of other languages are not needed by clients
+	localized.Labels = nil
+	if localized.Title == "" {
+		localized.Title = key
+	}
+	for _, option := range question.Options {
+		localized.OptionLabels = append(localized.OptionLabels,
+			questionnaire.optionLabel(question, option, language))
+	}
+	return localized
+}
+
+func (questionnaire SurveyQuestionnaireDocument) localizeSections(language string) map[string]string {
+	labels := map[string]string{}
+	for _, section := range questionnaire.Sections {
+		label, ok := questionnaire.SectionLabels[language][section]
+		if !ok {
+			label, ok = questionnaire.SectionLabels[DefaultLanguage][section]
+		}
+		if !ok {
+			label = section
+		}
+		labels[section] = label
+	}
+	return labels
+}
+
+func getLatestSurveyQuestionnaire(collection *mongo.Collection) (SurveyQuestionnaireDocument, error) {
+	if collection.Name() != SurveyQuestionCollectionName {
+		return SurveyQuestionnaireDocument{}, fmt.Errorf("got wrong collection: %s", collection.Name())
+	}
+
+	value, err := getCachedValue(CacheKeySurveyQuestionnaire, func() (any, error) {
+		findOptions := options.FindOne()
+		findOptions.SetSort(bson.D{{Key: "version", Value: -1}}) // -1 for descending order
+
+		var document SurveyQuestionnaireDocument
+		err := collection.FindOne(context.Background(), bson.M{}, findOptions).Decode(&document)
+		if err != nil {
+			return nil, err
+		}
+		return document, nil
+	})
+	if err != nil {
+		return SurveyQuestionnaireDocument{}, err
+	}
+	return value.(SurveyQuestionnaireDocument), nil
+}
+
+// Create the version index and insert the default questionnaire if the collection is empty
+func ensureSurveyQuestionCollection(collection *mongo.Collection) bool {
+	if collection.Name() != SurveyQuestionCollectionName {
+		log.Printf("Got wrong collection: %s", collection.Name())
+		return false
+	}
+
+	indexModel := mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "version", Value: 1}, // 1 for ascending order
+		},
+		Options: options.Index().SetUnique(true),
+	}
+	_, err := collection.Indexes().CreateOne(context.Background(), indexModel)
+	if err != nil {
+		log.Println("Could not create index in survey question collection: " + err.Error())
+		return false
+	}
+
+	totalCount, err := collection.CountDocuments(context.Background(), bson.M{})
+	if err != nil {
+		log.Println("Error in counting in ensureSurveyQuestionCollection: " + err.Error())
+		return false
+	} else if totalCount > 0 {
+		return true
+	}
+
+	document := DefaultSurveyQuestionnaire
+	document.Timestamp = time.Now().Format(TimestampFormat)
+	_, err = collection.InsertOne(context.Background(), document)
+	if err != nil {
+		log.Println("Failed to insert default survey questionnaire: " + err.Error())
+		return false
+	}
+	log.Println("Default survey questionnaire inserted")
+	return true
+}
+
+// Publish a new version with the conditions of the default questionnaire,
+// for questionnaires published before conditions were introduced. Run once by a command,
+// as a version without conditions can also be published on purpose.
+func addDefaultSurveyQuestionConditions(collection *mongo.Collection) bool {
+	if collection.Name() != SurveyQuestionCollectionName {
+		log.Printf("Got wrong collection: %s", collection.Name())
+		return false
+	}
+
+	latest, err := getLatestSurveyQuestionnaire(collection)
+	if err != nil {
+		log.Println("Error finding latest survey questionnaire: " + err.Error())
+		return false
+	}
+	for _, question := range latest.Questions {
+		if question.ShowIf != nil {
+			log.Printf("Survey questionnaire version %d already has question conditions", latest.Version)
+			return true
+		}
+	}
+
+	questions := map[string]SurveyQuestion{}
+	added := false
+	for key, question := range latest.Questions {
+		questions[key] = question
+		condition := DefaultSurveyQuestionnaire.Questions[key].ShowIf
+		if condition == nil {
+			continue
+		}
+		if _, ok := latest.Questions[condition.Question]; ok {
+			question.ShowIf = condition
+			questions[key] = question
+			added = true
+		}
+	}
+	if !added {
+		log.Printf("No question conditions to add to survey questionnaire version %d", latest.Version)
+		return true
+	}
+
+	document := latest
+	document.Version = latest.Version + 1
+	document.Timestamp = time.Now().Format(TimestampFormat)
+	document.Questions = questions
+	_, err = collection.InsertOne(context.Background(), document)
+	if err != nil {
+		log.Println("Failed to add survey question conditions: " + err.Error())
+		return false
+	}
+	invalidateCache(CacheKeySurveyQuestionnaire)
+	log.Printf("Survey questionnaire version %d is published with question conditions", document.Version)
+	return true
+}
+
+func validateSurveyQuestionnaire(request SurveyQuestionnairePostRequest) []FieldError {
+	errors := []FieldError{}
+
+	if len(request.Sections) == 0 {
+		errors = append(errors, FieldError{Field: "sections", Message: "sections are empty"})
+	}
+	if len(request.Questions) == 0 {
+		errors = append(errors, FieldError{Field: "questions", Message: "questions are empty"})
+	}
+
+	// Every supported language should be labeled,
+	// so that new questions can be served without an app release
+	for _, language := range SupportedLanguages {
+		for _, section := range request.Sections {
+			if request.SectionLabels[language][section] == "" {
+				errors = append(errors, FieldError{
+					Field:   fmt.Sprintf("sectionLabels.%s.%s", language, section),
+					Message: "section label is empty"})
+			}
+		}
+	}
+
+	for key, question := range request.Questions {
+		field := "questions." + key
+		for _, language := range SupportedLanguages {
+			label := question.Labels[language]
+			if label.Title == "" {
+				errors = append(errors, FieldError{Field: field + ".labels." + language + ".title",
+					Message: "title is empty"})
+			}
+			for _, option := range question.Options {
+				_, ok := label.Options[option]
+				if !ok && request.OptionLabels[language][option] == "" {
+					errors = append(errors, FieldError{Field: field + ".labels." + language + ".options." + option,
+						Message: "option label is empty"})
+				}
+			}
+		}
+		if !slices.Contains(request.Sections, question.Section) {
+			errors = append(errors, FieldError{Field: field + ".section",
+				Message: fmt.Sprintf("section %s is not in %v", question.Section, request.Sections)})
+		}
+		if question.State != "active" && question.State != "retired" {
+			errors = append(errors, FieldError{Field: field + ".state",
+				Message: "state should be active or retired"})
+		}
+
+		switch question.Type {
+		case "selection":
+			if len(question.Options) == 0 {
+				errors = append(errors, FieldError{Field: field + ".options",
+					Message: "options are empty"})
+			}
+		case "text":
+			if question.MaxTextLength <= 0 {
+				errors = append(errors, FieldError{Field: field + ".maxTextLength",
+					Message: "maxTextLength should be positive"})
+			}
+		default:
+			errors = append(errors, FieldError{Field: field + ".type",
+				Message: "type should be selection or text"})
+		}
+
+		if question.ShowIf != nil {
+			errors = append(errors, validateSurveyQuestionCondition(request.Questions, key)...)
+		}
+	}
+
+	return errors
+}
+
+func validateSurveyQuestionCondition(questions map[string]SurveyQuestion, key string) []FieldError {
+	errors := []FieldError{}
+	field := "questions." + key + ".showIf"
+	condition := questions[key].ShowIf
+
+	target, ok := questions[condition.Question]
+	if !ok || condition.Question == key {
+		return append(errors, FieldError{Field: field + ".question",
+			Message: fmt.Sprintf("question %s is not in questions", condition.Question)})
+	}
+	if target.Type != "selection" {
+		errors = append(errors, FieldError{Field: field + ".question",
+			Message: "condition question should be a selection question"})
+	}
+	if len(condition.Options) == 0 {
+		errors = append(errors, FieldError{Field: field + ".options", Message: "options are empty"})
+	}
+	for _, option := range condition.Options {
+		if !slices.Contains(target.Options, option) {
+			errors = append(errors, FieldError{Field: field + ".options",
+				Message: fmt.Sprintf("option %s is not in %v", option, target.Options)})
+		}
+	}
+
+	// Follow the conditions to find cycles
+	visited := map[string]bool{key: true}
+	for next := questions[condition.Question].ShowIf; next != nil; next = questions[next.Question].ShowIf {
+		if visited[next.Question] {
+			errors = append(errors, FieldError{Field: field, Message: "conditions are circular"})
+			break
+		}
+		visited[next.Question] = true
+	}
+	return errors
+}
+
+func handleGetSurveyQuestions(collection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		questionnaire, err := getLatestSurveyQuestionnaire(collection)
+		if err != nil {
+			log.Println("Error finding survey questionnaire: " + err.Error())
+			http.Error(w, "Error while finding survey questionnaire", http.StatusInternalServerError)
+			return
+		}
+
+		// Retired questions are not asked anymore
+		language := getRequestLanguage(r)
+		response := SurveyQuestionsResponse{
+			Version:       questionnaire.Version,
+			Language:      language,
+			Sections:      questionnaire.Sections,
+			SectionLabels: questionnaire.localizeSections(language),
+			Questions:     map[string]LocalizedSurveyQuestion{},
+		}
+		for key, question := range questionnaire.activeQuestions() {
+			response.Questions[key] = questionnaire.localizeQuestion(key, question, language)
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Content-Language", language)
+		w.Header().Add("Vary", "Accept-Language")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func handlePostSurveyQuestionnaire(collection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if collection.Name() != SurveyQuestionCollectionName {
+			log.Printf("Got wrong collection: %s", collection.Name())
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+
+		var request SurveyQuestionnairePostRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Println("Failed to decode survey questionnaire post request: " + err.Error())
+			return
+		}
+
+		fieldErrors := validateSurveyQuestionnaire(request)
+		if len(fieldErrors) > 0 {
+			writeFieldErrors(w, fieldErrors)
+			return
+		}
+
+		// Read the latest version directly to not depend on the cache
+		findOptions := options.FindOne()
+		findOptions.SetSort(bson.D{{Key: "version", Value: -1}}) // -1 for descending order
+		var latest SurveyQuestionnaireDocument
+		err = collection.FindOne(context.Background(), bson.M{}, findOptions).Decode(&latest)
+		if err != nil && err != mongo.ErrNoDocuments {
+			log.Println("Error finding latest survey questionnaire: " + err.Error())
+			http.Error(w, "Error while finding survey questionnaire", http.StatusInternalServerError)
+			return
+		}
+
+		// Questions and options of the previous version can not be removed, only retired,
+		// as their answers are still stored
+		for key, previous := range latest.Questions {
+			question, ok := request.Questions[key]
+			if !ok {
+				fieldErrors = append(fieldErrors, FieldError{Field: "questions." + key,
+					Message: "question can not be removed, retire it instead"})
+				continue
+			}
+			for _, option := range previous.Options {
+				if !slices.Contains(question.Options, option) {
+					fieldErrors = append(fieldErrors, FieldError{Field: "questions." + key + ".options." + option,
+						Message: "option can not be removed, retire the question instead"})
+				}
+			}
+		}
+		if len(fieldErrors) > 0 {
+			writeFieldErrors(w, fieldErrors)
+			return
+		}
+
+		document := SurveyQuestionnaireDocument{
+			Version:       latest.Version + 1,
+			Timestamp:     time.Now().Format(TimestampFormat),
+			Sections:      request.Sections,
+			SectionLabels: request.SectionLabels,
+			OptionLabels:  request.OptionLabels,
+			Questions:     request.Questions,
+		}
+		// The unique version index rejects concurrent posts of the same version
+		_, err = collection.InsertOne(context.Background(), document)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Println("Failed to save survey questionnaire: " + err.Error())
+			return
+		}
+		invalidateCache(CacheKeySurveyQuestionnaire)
+		log.Printf("Survey questionnaire version %d is published", document.Version)
+
+		response := SurveyQuestionnairePostResponse{
+			Version: document.Version,
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(response)
+	}
+}
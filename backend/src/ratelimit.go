@@ -0,0 +1,212 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Budget of a route: requests per period for each user, and more for each IP
+// as several users can share an IP
+type rateLimitBudget struct {
+	requests int
+	period   time.Duration
+}
+
+// Token bucket of a client
+type rateLimitBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+type rateLimitData struct {
+	mutex         sync.Mutex
+	budget        rateLimitBudget
+	buckets       map[string]*rateLimitBucket
+	allowedCount  int
+	ipRejected    int
+	userRejected  int
+	lastRejection time.Time
+}
+
+var _rateLimitMap = make(map[string]*rateLimitData)
+
+// Set by -trusted-proxies flag on start. Forwarded headers are used only from these addresses.
+var _trustedProxies = []*net.IPNet{}
+
+// Parse comma separated IPs or CIDRs of trusted proxies
+func parseTrustedProxies(value string) ([]*net.IPNet, error) {
+	proxies := []*net.IPNet{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func startRateLimiter(budgets map[string]rateLimitBudget) {
+	for key, budget := range budgets {
+		_rateLimitMap[key] = &rateLimitData{
+			mutex:   sync.Mutex{},
+			budget:  budget,
+			buckets: map[string]*rateLimitBucket{},
+		}
+	}
+
+	// Remove buckets of idle clients, which are full anyway
+	go func() {
+		for range time.Tick(RateLimitCleanupInterval) {
+			for _, limit := range _rateLimitMap {
+				limit.mutex.Lock()
+				for client, bucket := range limit.buckets {
+					if time.Since(bucket.updatedAt) > limit.budget.period {
+						delete(limit.buckets, client)
+					}
+				}
+				limit.mutex.Unlock()
+			}
+		}
+	}()
+}
+
+// Take a token from the bucket of the client, or return how long to wait for one
+func (limit *rateLimitData) take(client string, capacity int, now time.Time) (bool, time.Duration) {
+	rate := float64(capacity) / limit.budget.period.Seconds() // Tokens per second
+
+	bucket, ok := limit.buckets[client]
+	if !ok {
+		bucket = &rateLimitBucket{tokens: float64(capacity), updatedAt: now}
+		limit.buckets[client] = bucket
+	}
+	bucket.tokens = min(bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*rate, float64(capacity))
+	bucket.updatedAt = now
+
+	if bucket.tokens < 1 {
+		wait := (1 - bucket.tokens) / rate
+		return false, time.Duration(wait * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// Check the budget of the IP, and of the user if given.
+// A rejected request doesn't consume tokens of the other bucket.
+func checkRateLimit(key string, ip string, userId string) (bool, time.Duration) {
+	limit, ok := _rateLimitMap[key]
+	if !ok {
+		log.Println("Wrong rate limit key: ", key)
+		return true, 0
+	}
+
+	limit.mutex.Lock()
+	defer limit.mutex.Unlock()
+
+	now := time.Now()
+	allowed, wait := limit.take("ip:"+ip, limit.budget.requests*RateLimitIpMultiplier, now)
+	if !allowed {
+		limit.ipRejected++
+		limit.lastRejection = now
+		return false, wait
+	}
+	if userId != "" {
+		allowed, wait = limit.take("user:"+userId, limit.budget.requests, now)
+		if !allowed {
+			// Give back the token of the IP
+			limit.buckets["ip:"+ip].tokens++
+			limit.userRejected++
+			limit.lastRejection = now
+			return false, wait
+		}
+	}
+	limit.allowedCount++
+	return true, 0
+}
+
+// Client IP set by a trusted proxy, or the remote address otherwise, as forwarded headers
+// from others can be forged. The last X-Forwarded-For entry is the one added by the proxy.
+func getClientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote := net.ParseIP(host)
+	trusted := false
+	for _, proxy := range _trustedProxies {
+		if remote != nil && proxy.Contains(remote) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return host
+	}
+
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-Ip")); ip != "" {
+		return ip
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		entries := strings.Split(forwarded, ",")
+		if ip := strings.TrimSpace(entries[len(entries)-1]); ip != "" {
+			return ip
+		}
+	}
+	return host
+}
+
+// Reject requests over the budget of the route with 429 and Retry-After.
+// Wrap it with withDeviceUser so that the user budget applies to the user of the device token.
+// Requests without tokens in the legacy mode are limited by IP only,
+// as user ids in the requests are chosen by clients.
+func withRateLimit(key string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		allowed, wait := checkRateLimit(key, getClientIp(r), getDeviceUserId(r))
+		if !allowed {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func logRateLimitSummary() {
+	for key, limit := range _rateLimitMap {
+		limit.mutex.Lock()
+
+		// Print result
+		lastRejection := "-"
+		if !limit.lastRejection.IsZero() {
+			lastRejection = limit.lastRejection.Format(TimestampFormat)
+		}
+		log.Printf("[Rate limit summary] key: %s, allowed: %d, rejected by ip: %d, rejected by user: %d, "+
+			"clients: %d, last rejection: %s\n", key, limit.allowedCount, limit.ipRejected,
+			limit.userRejected, len(limit.buckets), lastRejection)
+
+		// Reset data
+		limit.allowedCount = 0
+		limit.ipRejected = 0
+		limit.userRejected = 0
+
+		limit.mutex.Unlock()
+	}
+}
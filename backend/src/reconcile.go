@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Paired writes can be partially applied without transactions (standalone server),
+// so the derived documents are compared with the source collections and repaired.
+
+type userHospitalsResult struct {
+	UserId      string   `bson:"_id"`
+	HospitalIds []string `bson:"hospitalIds"`
+}
+
+// Hospital ids of each user, from survey documents
+func aggregateUserHospitals(collection *mongo.Collection) (map[string][]string, error) {
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.M{"userId": bson.M{"$exists": true}}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$userId"},
+			{Key: "hospitalIds", Value: bson.D{{Key: "$addToSet", Value: "$hospitalId"}}},
+		}}},
+	}
+	cursor, err := collection.Aggregate(context.Background(), pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	var results []userHospitalsResult
+	if err = cursor.All(context.Background(), &results); err != nil {
+		return nil, err
+	}
+
+	hospitals := map[string][]string{}
+	for _, result := range results {
+		hospitals[result.UserId] = result.HospitalIds
+	}
+	return hospitals, nil
+}
+
+func equalHospitalIds(a []string, b []string) bool {
+	a = slices.Clone(a)
+	b = slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(slices.Compact(a), slices.Compact(b))
+}
+
+// Compare surveys of user documents with the survey collection, and overwrite mismatched ones.
+// Legacy likes of user documents are removed, as likes are read from the like collection.
+// Returns ids of the repaired users.
+func reconcileUserDocuments(userCollection *mongo.Collection,
+	surveyCollection *mongo.Collection) ([]string, error) {
+	if userCollection.Name() != UserCollectionName ||
+		surveyCollection.Name() != SurveyCollectionName {
+		return nil, fmt.Errorf("wrong collection is assigned")
+	}
+
+	result, err := userCollection.UpdateMany(context.Background(),
+		bson.M{"likes": bson.M{"$exists": true}}, bson.M{"$unset": bson.M{"likes": ""}})
+	if err != nil {
+		return nil, err
+	}
+	if result.ModifiedCount > 0 {
+		log.Printf("Removed legacy likes of %d users", result.ModifiedCount)
+	}
+
+	surveys, err := aggregateUserHospitals(surveyCollection)
+	if err != nil {
+		return nil, err
+	}
+
+	// Users that should exist
+	expected := map[string]UserDocument{}
+	for userId, hospitalIds := range surveys {
+		expected[userId] = UserDocument{UserId: userId, Surveys: hospitalIds}
+	}
+
+	cursor, err := userCollection.Find(context.Background(), bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	mismatches := []string{}
+	found := map[string]bool{}
+	for cursor.Next(context.Background()) {
+		var document UserDocument
+		err = cursor.Decode(&document)
+		if err != nil {
+			log.Println("User cursor decode error: " + err.Error())
+			continue
+		}
+		found[document.UserId] = true
+
+		// Users without surveys are kept with empty lists
+		want, ok := expected[document.UserId]
+		if !ok {
+			want = UserDocument{UserId: document.UserId}
+		}
+		if !equalHospitalIds(document.Surveys, want.Surveys) {
+			mismatches = append(mismatches, document.UserId)
+		}
+	}
+	for userId := range expected {
+		if !found[userId] {
+			mismatches = append(mismatches, userId)
+		}
+	}
+
+	for _, userId := range mismatches {
+		want := expected[userId]
+		update := bson.M{"$set": bson.M{"surveys": append([]string{}, want.Surveys...)}}
+		_, err = userCollection.UpdateOne(context.Background(), bson.M{"_id": userId}, update,
+			options.Update().SetUpsert(true))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return mismatches, nil
+}
+
+// Compare like counts with the like documents. Returns ids of the mismatched hospitals.
+func verifyLikeCounts(likeCollection *mongo.Collection, likeCountCollection *mongo.Collection) ([]string, error) {
+	if likeCollection.Name() != LikeCollectionName ||
+		likeCountCollection.Name() != LikeCountCollectionName {
+		return nil, fmt.Errorf("wrong collection is assigned")
+	}
+
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.M{"userId": bson.M{"$exists": true}}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$hospitalId"},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+	}
+	cursor, err := likeCollection.Aggregate(context.Background(), pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var computed []LikeCountDocument
+	if err = cursor.All(context.Background(), &computed); err != nil {
+		return nil, err
+	}
+
+	cursor, err = likeCountCollection.Find(context.Background(), bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var stored []LikeCountDocument
+	if err = cursor.All(context.Background(), &stored); err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int{}
+	for _, document := range stored {
+		counts[document.HospitalId] = document.Count
+	}
+	mismatches := []string{}
+	for _, document := range computed {
+		if counts[document.HospitalId] != document.Count {
+			mismatches = append(mismatches, document.HospitalId)
+		}
+		delete(counts, document.HospitalId)
+	}
+	// Remaining counts have no likes
+	for hospitalId, count := range counts {
+		if count != 0 {
+			mismatches = append(mismatches, hospitalId)
+		}
+	}
+	return mismatches, nil
+}
+
+// Detect and repair mismatches of user documents, like counts and survey summaries
+func reconcile(db *mongo.Database) bool {
+	surveyCollection := db.Collection(SurveyCollectionName)
+	summaryCollection := db.Collection(SurveySummaryCollectionName)
+	likeCollection := db.Collection(LikeCollectionName)
+	likeCountCollection := db.Collection(LikeCountCollectionName)
+	userCollection := db.Collection(UserCollectionName)
+	hospitalCollection := db.Collection(HospitalCollectionName)
+	settingCollection := db.Collection(SettingCollectionName)
+
+	success := true
+
+	users, err := reconcileUserDocuments(userCollection, surveyCollection)
+	if err != nil {
+		log.Println("Failed to reconcile users: " + err.Error())
+		success = false
+	} else if len(users) > 0 {
+		log.Printf("Repaired %d users: %v", len(users), users)
+	} else {
+		log.Println("Users are consistent")
+	}
+
+	hospitals, err := verifyLikeCounts(likeCollection, likeCountCollection)
+	if err != nil {
+		log.Println("Failed to verify like counts: " + err.Error())
+		success = false
+	} else if len(hospitals) > 0 {
+		log.Printf("Like counts of %d hospitals are inconsistent: %v", len(hospitals), hospitals)
+		if err = rebuildLikeCounts(likeCollection, likeCountCollection); err != nil {
+			log.Println("Failed to rebuild like counts: " + err.Error())
+			success = false
+		} else {
+			log.Println("Rebuilt like counts")
+		}
+	} else {
+		log.Println("Like counts are consistent")
+	}
+
+	hospitals, err = verifySurveySummaries(surveyCollection, summaryCollection)
+	if err != nil {
+		log.Println("Failed to verify survey summaries: " + err.Error())
+		success = false
+	} else if len(hospitals) > 0 {
+		log.Printf("Survey summaries of %d hospitals are inconsistent: %v", len(hospitals), hospitals)
+		count, err := rebuildSurveySummariesOf(surveyCollection, summaryCollection, hospitals)
+		if err != nil {
+			log.Println("Failed to rebuild survey summaries: " + err.Error())
+			success = false
+		} else {
+			log.Printf("Rebuilt survey summaries of %d hospitals", count)
+		}
+
+		// Scores are kept on rebuild, refresh them with the repaired counts
+		if err = refreshScores(hospitalCollection, summaryCollection, settingCollection); err != nil {
+			log.Println("Failed to refresh scores: " + err.Error())
+			success = false
+		}
+	} else {
+		log.Println("Survey summaries are consistent")
+	}
+
+	return success
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+)
+
+// Get 시/군/구 region from the address, including the province.
+// e.g. "서울특별시 강남구 역삼로 123" -> "서울특별시 강남구"
+//
+//	"경기도 성남시 분당구 정자일로 1" -> "경기도 성남시 분당구"
+//	"세종특별자치시 한누리대로 2130" -> "세종특별자치시"
+func getRegion(address string) string {
+	fields := strings.Fields(address)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	region := fields[0]
+	if len(fields) < 2 || !isDistrictName(fields[1]) {
+		return region
+	}
+	region += " " + fields[1]
+
+	// Cities with districts (e.g. 성남시 분당구)
+	if strings.HasSuffix(fields[1], "시") && len(fields) > 2 && strings.HasSuffix(fields[2], "구") {
+		region += " " + fields[2]
+	}
+	return region
+}
+
+func isDistrictName(name string) bool {
+	return strings.HasSuffix(name, "시") ||
+		strings.HasSuffix(name, "군") ||
+		strings.HasSuffix(name, "구")
+}
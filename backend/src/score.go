@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Model to score hospitals from ordinal survey answers.
+// Scores are shrunk toward the regional mean by the prior weight,
+// so that hospitals with a few answers do not get extreme scores.
+type ScoreModel struct {
+	Values           map[string]map[string]float64 `bson:"values" json:"values"`                     // Question -> option -> value
+	PriorWeight      float64                       `bson:"priorWeight" json:"priorWeight"`           // Number of pseudo answers with the regional mean
+	PriorMean        float64                       `bson:"priorMean" json:"priorMean"`               // Used when the nation has no answers
+	MinRegionalCount int                           `bson:"minRegionalCount" json:"minRegionalCount"` // Regions with less answers use the national mean
+}
+
+type ScoreModelDocument struct {
+	Id         string `bson:"_id"`
+	ScoreModel `bson:",inline"`
+	LastUpdate string `bson:"lastUpdate"`
+}
+
+type scoreStats struct {
+	sum   float64
+	count float64
+}
+
+type regionalScoreData struct {
+	mutex        sync.RWMutex
+	means        map[string]float64
+	nationalMean float64
+}
+
+var DefaultScoreModel = ScoreModel{
+	Values: map[string]map[string]float64{
+		"kindness":     {"kind": 5, "average": 3, "no": 1},
+		"thoroughness": {"thorough": 5, "average": 3, "no": 1},
+		"cleanliness":  {"clean": 5, "average": 3, "no": 1},
+		"waitingSpace": {"bigSpace": 5, "average": 3, "smallSpace": 1},
+	},
+	PriorWeight:      10,
+	PriorMean:        3,
+	MinRegionalCount: 30,
+}
+
+var _regionalScore = regionalScoreData{
+	mutex:        sync.RWMutex{},
+	means:        map[string]float64{},
+	nationalMean: DefaultScoreModel.PriorMean,
+}
+
+// Counts are weighted by the trust of the authors
+func (model ScoreModel) getStats(counts map[string]map[string]float64) scoreStats {
+	stats := scoreStats{}
+	for question, values := range model.Values {
+		for option, value := range values {
+			count := counts[question][option]
+			stats.sum += value * count
+			stats.count += count
+		}
+	}
+	return stats
+}
+
+// Returns the score and the confidence (0 ~ 1) of the score
+func (model ScoreModel) computeScore(stats scoreStats, priorMean float64) (float64, float64) {
+	if stats.count+model.PriorWeight <= 0 {
+		return priorMean, 0
+	}
+	score := (model.PriorWeight*priorMean + stats.sum) / (model.PriorWeight + stats.count)
+	confidence := stats.count / (model.PriorWeight + stats.count)
+	return score, confidence
+}
+
+func validateScoreModel(model ScoreModel) []FieldError {
+	errors := []FieldError{}
+	if len(model.Values) == 0 {
+		errors = append(errors, FieldError{Field: "values", Message: "values are empty"})
+	}
+	for question, values := range model.Values {
+		if len(values) == 0 {
+			errors = append(errors, FieldError{Field: "values." + question, Message: "option values are empty"})
+		}
+	}
+	if model.PriorWeight < 0 {
+		errors = append(errors, FieldError{Field: "priorWeight", Message: "priorWeight should not be negative"})
+	}
+	if model.MinRegionalCount < 0 {
+		errors = append(errors, FieldError{Field: "minRegionalCount", Message: "minRegionalCount should not be negative"})
+	}
+	return errors
+}
+
+func getScoreModel(collection *mongo.Collection) ScoreModel {
+	if collection.Name() != SettingCollectionName {
+		log.Printf("Got wrong collection: %s", collection.Name())
+		return DefaultScoreModel
+	}
+
+	value, err := getCachedValue(CacheKeyScoreModel, func() (any, error) {
+		var document ScoreModelDocument
+		err := collection.FindOne(context.Background(), bson.M{"_id": SettingKeyScoreModel}).Decode(&document)
+		if err == mongo.ErrNoDocuments {
+			return DefaultScoreModel, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return document.ScoreModel, nil
+	})
+	if err != nil {
+		log.Println("Error finding score model: " + err.Error())
+		return DefaultScoreModel
+	}
+	return value.(ScoreModel)
+}
+
+func getRegionalScoreMean(region string) float64 {
+	_regionalScore.mutex.RLock()
+	defer _regionalScore.mutex.RUnlock()
+
+	mean, ok := _regionalScore.means[region]
+	if !ok {
+		return _regionalScore.nationalMean
+	}
+	return mean
+}
+
+func getHospitalScore(model ScoreModel, summary SurveySummaryDocument, address string) (float64, float64) {
+	return model.computeScore(model.getStats(summary.getWeightedCounts()), getRegionalScoreMean(getRegion(address)))
+}
+
+// Recompute regional means and survey benchmarks, and store scores to survey summaries for sorting
+func refreshScores(hospitalCollection *mongo.Collection,
+	summaryCollection *mongo.Collection,
+	settingCollection *mongo.Collection) error {
+	if hospitalCollection.Name() != HospitalCollectionName ||
+		summaryCollection.Name() != SurveySummaryCollectionName {
+		return fmt.Errorf("wrong collection is assigned")
+	}
+
+	model := getScoreModel(settingCollection)
+
+	// Get stats of hospitals
+	cursor, err := summaryCollection.Find(context.Background(), bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	summaries := []SurveySummaryDocument{}
+	hospitalStats := map[string]scoreStats{}
+	hospitalIds := []string{}
+	for cursor.Next(context.Background()) {
+		var summary SurveySummaryDocument
+		err = cursor.Decode(&summary)
+		if err != nil {
+			log.Println("Survey summary cursor decode error: " + err.Error())
+			continue
+		}
+		summaries = append(summaries, summary)
+		hospitalStats[summary.HospitalId] = model.getStats(summary.getWeightedCounts())
+		hospitalIds = append(hospitalIds, summary.HospitalId)
+	}
+
+	// Get regions of hospitals
+	hospitalRegions, err := getHospitalRegions(hospitalCollection, hospitalIds)
+	if err != nil {
+		return err
+	}
+
+	// Compute regional and national means
+	national := scoreStats{}
+	regionStats := map[string]scoreStats{}
+	for hospitalId, stats := range hospitalStats {
+		region := hospitalRegions[hospitalId]
+		regional := regionStats[region]
+		regional.sum += stats.sum
+		regional.count += stats.count
+		regionStats[region] = regional
+		national.sum += stats.sum
+		national.count += stats.count
+	}
+
+	nationalMean := model.PriorMean
+	if national.count > 0 {
+		nationalMean = national.sum / national.count
+	}
+	means := map[string]float64{}
+	for region, stats := range regionStats {
+		if region != "" && stats.count >= float64(model.MinRegionalCount) && stats.count > 0 {
+			means[region] = stats.sum / stats.count
+		}
+	}
+
+	_regionalScore.mutex.Lock()
+	_regionalScore.means = means
+	_regionalScore.nationalMean = nationalMean
+	_regionalScore.mutex.Unlock()
+
+	refreshSurveyBenchmarks(model, summaries, hospitalRegions)
+
+	// Store scores, and copy them to hospitals so that hospitals can be sorted by score with an index
+	models := []mongo.WriteModel{}
+	hospitalModels := []mongo.WriteModel{}
+	for hospitalId, stats := range hospitalStats {
+		region := hospitalRegions[hospitalId]
+		score, confidence := model.computeScore(stats, getRegionalScoreMean(region))
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": hospitalId}).
+			SetUpdate(bson.M{"$set": bson.M{
+				"region":          region,
+				"score":           score,
+				"scoreConfidence": confidence,
+			}}))
+		hospitalModels = append(hospitalModels, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": hospitalId}).
+			SetUpdate(bson.M{"$set": bson.M{"score": score}}))
+	}
+	if len(models) > 0 {
+		_, err = summaryCollection.BulkWrite(context.Background(), models,
+			options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return err
+		}
+		_, err = hospitalCollection.BulkWrite(context.Background(), hospitalModels,
+			options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Refreshed scores of %d hospitals in %d regions, national mean: %.3f",
+		len(hospitalStats), len(means), nationalMean)
+	return nil
+}
+
+func getHospitalRegions(collection *mongo.Collection, hospitalIds []string) (map[string]string, error) {
+	regions := map[string]string{}
+	if len(hospitalIds) == 0 {
+		return regions, nil
+	}
+
+	findOptions := options.Find().SetProjection(bson.M{"dutyAddr": 1})
+	cursor, err := collection.Find(context.Background(),
+		bson.M{"_id": bson.M{"$in": hospitalIds}}, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(context.Background()) {
+		var hospital DatabaseHospital
+		err = cursor.Decode(&hospital)
+		if err != nil {
+			log.Println("Hospital cursor decode error: " + err.Error())
+			continue
+		}
+		regions[hospital.Hpid] = getRegion(hospital.DutyAddr)
+	}
+	return regions, nil
+}
+
+func startScoreRefresher(hospitalCollection *mongo.Collection,
+	summaryCollection *mongo.Collection,
+	settingCollection *mongo.Collection) {
+	refresh := func() {
+		err := refreshScores(hospitalCollection, summaryCollection, settingCollection)
+		if err != nil {
+			log.Println("Failed to refresh scores: " + err.Error())
+		}
+	}
+
+	refresh()
+	go func() {
+		for range time.Tick(ScoreRefreshInterval) {
+			refresh()
+		}
+	}()
+}
+
+func handleGetScoreModel(collection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if collection.Name() != SettingCollectionName {
+			log.Printf("Got wrong collection: %s", collection.Name())
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(getScoreModel(collection))
+	}
+}
+
+func handlePostScoreModel(hospitalCollection *mongo.Collection,
+	summaryCollection *mongo.Collection,
+	settingCollection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if hospitalCollection.Name() != HospitalCollectionName ||
+			summaryCollection.Name() != SurveySummaryCollectionName ||
+			settingCollection.Name() != SettingCollectionName {
+			log.Println("Wrong collection is assigned")
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+
+		var model ScoreModel
+		err := json.NewDecoder(r.Body).Decode(&model)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Println("Failed to decode score model post request: " + err.Error())
+			return
+		}
+
+		fieldErrors := validateScoreModel(model)
+		if len(fieldErrors) > 0 {
+			writeFieldErrors(w, fieldErrors)
+			return
+		}
+
+		document := ScoreModelDocument{
+			Id:         SettingKeyScoreModel,
+			ScoreModel: model,
+			LastUpdate: time.Now().Format(TimestampFormat),
+		}
+		_, err = settingCollection.ReplaceOne(context.Background(),
+			bson.M{"_id": SettingKeyScoreModel}, document, options.Replace().SetUpsert(true))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Println("Failed to save score model: " + err.Error())
+			return
+		}
+		invalidateCache(CacheKeyScoreModel)
+
+		// Apply the new model right away
+		err = refreshScores(hospitalCollection, summaryCollection, settingCollection)
+		if err != nil {
+			log.Println("Failed to refresh scores: " + err.Error())
+		}
+
+		fmt.Fprintf(w, "Score model updated")
+	}
+}
@@ -6,24 +6,16 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-type SurveyQuestion struct {
-	Type          string   `json:"type"` // "selection", "text"
-	Options       []string `json:"options"`
-	MaxTextLength int      `json:"maxTextLength"`
-}
-
-type SurveyQuestionsResponse struct {
-	Questions map[string]SurveyQuestion `json:"questions"`
-}
-
 type SurveyAnswer struct {
 	Type   string `bson:"type" json:"type"`
 	Option string `bson:"option" json:"option"`
@@ -31,110 +23,63 @@ type SurveyAnswer struct {
 }
 
 type SurveyAnswerDocument struct {
-	HospitalId string                  `json:"hospitalId"`
-	UserId     string                  `json:"userId"`
-	Timestamp  string                  `json:"timestamp"`
-	Answers    map[string]SurveyAnswer `json:"answers"`
+	HospitalId           string                  `json:"hospitalId"`
+	UserId               string                  `json:"userId"`
+	Timestamp            Timestamp               `json:"timestamp"`            // Filled by the server
+	QuestionnaireVersion int                     `json:"questionnaireVersion"` // Filled by the server
+	Answers              map[string]SurveyAnswer `json:"answers"`
+	Hidden               bool                    `bson:"hidden,omitempty" json:"-"` // Hidden from summaries by reports
+	Trust                float64                 `bson:"trust,omitempty" json:"-"`  // Trust of the author, weight in summaries
+}
+
+// Surveys submitted before trust scores weigh 1
+func (document SurveyAnswerDocument) getTrust() float64 {
+	if document.Trust <= 0 {
+		return 1
+	}
+	return document.Trust
 }
 
 type SurveySummary struct {
-	Type         string   `json:"type"`
-	Options      []string `json:"options"`
-	OptionCounts []int    `json:"optionCounts"`
-	Texts        []string `json:"texts"`
+	Type          string      `json:"type"`
+	Options       []string    `json:"options"`
+	OptionCounts  []int       `json:"optionCounts"`
+	OptionWeights []float64   `json:"optionWeights"` // Option counts weighted by the trust of the authors
+	AnswerCount   int         `json:"answerCount"`   // Sum of option counts, excluding surveys the question was not applicable to
+	Texts         []string    `json:"texts"`
+	Tips          []SurveyTip `json:"tips"`     // Most helpful approved texts with timestamps
+	TipCount      int         `json:"tipCount"` // Total approved texts, for paging with /v1/survey/tips
+
+	// Comparison with the region, not available for time-windowed summaries
+	Benchmark *SurveyBenchmark `json:"benchmark,omitempty"`
 }
 
 type SurveySummaryResponse struct {
 	HospitalId string                   `json:"hospitalId"`
+	Since      string                   `json:"since,omitempty"` // Beginning of the time window if requested
 	TotalCount int                      `json:"totalCount"`
 	Summaries  map[string]SurveySummary `json:"summaries"`
 }
 
-var SurveyQuestionMap = map[string]SurveyQuestion{
-	// Space
-	"waitingSpace": {
-		Type: "selection",
-		Options: []string{
-			"smallSpace", "average", "bigSpace",
-		},
-	},
-	"parkingDifficulty": {
-		Type: "selection",
-		Options: []string{
-			"easy", "hard",
-		},
-	},
-	"cleanliness": {
-		Type: "selection",
-		Options: []string{
-			"clean", "average", "no",
-		},
-	},
-	// Treatment
-	"kindness": {
-		Type: "selection",
-		Options: []string{
-			"kind", "average", "no",
-		},
-	},
-	"thoroughness": {
-		Type: "selection",
-		Options: []string{
-			"thorough", "average", "no",
-		},
-	},
-	"medicineStrength": {
-		Type: "selection",
-		Options: []string{
-			"weak", "average", "strong",
-		},
-	},
-	"ivTreatment": {
-		Type: "selection",
-		Options: []string{
-			"do", "dont",
-		},
-	},
-	"whenToVisit": {
-		Type: "selection",
-		Options: []string{
-			"littleSick", "verySick",
-		},
-	},
-	// Checkup
-	"checkupAvailable": {
-		Type: "selection",
-		Options: []string{
-			"do", "dont",
-		},
-	},
-	"checkupWaiting": {
-		Type: "selection",
-		Options: []string{
-			"below1day", "below7day", "over7day",
-		},
-	},
-	// Unused
-	"morningWaiting": {
-		Type: "selection",
-		Options: []string{
-			"below15min", "below30min", "below60min", "over60min",
-		},
-	},
-	"afternoonWaiting": {
-		Type: "selection",
-		Options: []string{
-			"below15min", "below30min", "below60min", "over60min",
-		},
-	},
-	"tipForVisitors": {
-		Type:          "text",
-		MaxTextLength: 20,
-	},
+type SurveySummariesRequest struct {
+	HospitalIds []string `json:"hospitalIds"`
+}
+
+type SurveyTrendMonth struct {
+	Month        string `json:"month"` // YYYY-MM
+	TotalCount   int    `json:"totalCount"`
+	OptionCounts []int  `json:"optionCounts"` // Same order as options
+}
+
+type SurveyTrendResponse struct {
+	HospitalId string             `json:"hospitalId"`
+	Question   string             `json:"question"`
+	Options    []string           `json:"options"`
+	Months     []SurveyTrendMonth `json:"months"`
 }
 
 func getSurveyCount(collection *mongo.Collection, hospitalId string) int {
-	filter := bson.M{"hospitalId": hospitalId}
+	filter := bson.M{"hospitalId": hospitalId, "hidden": bson.M{"$ne": true}}
 
 	// Get the total count of documents matching the filter
 	totalCount, err := collection.CountDocuments(context.Background(), filter)
@@ -163,16 +108,34 @@ func ensureSurveyCollectionIndex(collection *mongo.Collection) bool {
 	}
 
 	// Index model for hospital ID and user ID using bson.D for ordered keys
-	indexModel := mongo.IndexModel{
-		Keys: bson.D{
-			{Key: "hospitalId", Value: 1}, // 1 for ascending order
-			{Key: "userId", Value: 1},
+	indexModels := []mongo.IndexModel{
+		{
+			Keys: bson.D{
+				{Key: "hospitalId", Value: 1}, // 1 for ascending order
+				{Key: "userId", Value: 1},
+			},
+			Options: options.Index().SetUnique(false),
+		},
+		// For the activity rate of a user
+		{
+			Keys: bson.D{
+				{Key: "userId", Value: 1},
+				{Key: "timestamp", Value: -1},
+			},
+			Options: options.Index().SetUnique(false),
+		},
+		// For time-windowed summaries and trends
+		{
+			Keys: bson.D{
+				{Key: "hospitalId", Value: 1},
+				{Key: "timestamp", Value: -1}, // -1 for descending order
+			},
+			Options: options.Index().SetUnique(false),
 		},
-		Options: options.Index().SetUnique(false),
 	}
 
 	// Create the index
-	_, err = collection.Indexes().CreateOne(context.Background(), indexModel)
+	_, err = collection.Indexes().CreateMany(context.Background(), indexModels)
 	if err != nil {
 		log.Println("Could not create index in survey collection: " + err.Error())
 	} else {
@@ -181,23 +144,144 @@ func ensureSurveyCollectionIndex(collection *mongo.Collection) bool {
 	return true
 }
 
-func handleGetSurveyQuestions() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
-			return
+// Convert legacy string timestamps, which were filled by clients, to dates.
+// Timestamps that can not be parsed are replaced with the creation time of the document.
+func migrateSurveyTimestamps(collection *mongo.Collection) bool {
+	if collection.Name() != SurveyCollectionName {
+		log.Printf("Got wrong collection: %s", collection.Name())
+		return false
+	}
+
+	filter := bson.M{"timestamp": bson.M{"$not": bson.M{"$type": "date"}}}
+	update := mongo.Pipeline{
+		bson.D{{Key: "$set", Value: bson.D{{Key: "timestamp", Value: bson.D{
+			{Key: "$dateFromString", Value: bson.D{
+				{Key: "dateString", Value: "$timestamp"},
+				{Key: "format", Value: "%Y-%m-%d %H:%M:%S"},
+				{Key: "timezone", Value: time.Local.String()},
+				{Key: "onError", Value: bson.D{{Key: "$toDate", Value: "$_id"}}},
+				{Key: "onNull", Value: bson.D{{Key: "$toDate", Value: "$_id"}}},
+			}},
+		}}}}},
+	}
+
+	result, err := collection.UpdateMany(context.Background(), filter, update)
+	if err != nil {
+		log.Println("Failed to migrate survey timestamps: " + err.Error())
+		return false
+	}
+	if result.ModifiedCount > 0 {
+		log.Printf("Migrated %d survey timestamps to dates", result.ModifiedCount)
+	}
+	return true
+}
+
+// Move answers of questions which were not applicable to excludedAnswers,
+// so that they are not counted in summaries. Answers saved before the conditions
+// were introduced can be inconsistent, while new answers are validated on submission.
+func excludeInapplicableSurveyAnswers(collection *mongo.Collection,
+	questionnaire SurveyQuestionnaireDocument) (int64, error) {
+	if collection.Name() != SurveyCollectionName {
+		return 0, fmt.Errorf("got wrong collection: %s", collection.Name())
+	}
+
+	// Repeat for chained conditions
+	var total int64
+	for pass := 0; pass < len(questionnaire.Questions); pass++ {
+		var modified int64
+		for key, question := range questionnaire.Questions {
+			if question.ShowIf == nil {
+				continue
+			}
+			filter := bson.M{
+				"answers." + key: bson.M{"$exists": true},
+				"answers." + question.ShowIf.Question + ".option": bson.M{"$nin": question.ShowIf.Options},
+			}
+			update := bson.M{"$rename": bson.M{"answers." + key: "excludedAnswers." + key}}
+			result, err := collection.UpdateMany(context.Background(), filter, update)
+			if err != nil {
+				return total, err
+			}
+			modified += result.ModifiedCount
+		}
+		total += modified
+		if modified == 0 {
+			break
 		}
+	}
+	return total, nil
+}
+
+func validateSurveyAnswerDocument(document SurveyAnswerDocument,
+	questionnaire SurveyQuestionnaireDocument) []FieldError {
+	errors := []FieldError{}
+
+	if strings.TrimSpace(document.HospitalId) == "" {
+		errors = append(errors, FieldError{Field: "hospitalId", Message: "hospitalId is empty"})
+	}
+	if strings.TrimSpace(document.UserId) == "" {
+		errors = append(errors, FieldError{Field: "userId", Message: "userId is empty"})
+	}
+	if len(document.Answers) == 0 {
+		errors = append(errors, FieldError{Field: "answers", Message: "answers are empty"})
+	}
 
-		response := SurveyQuestionsResponse{
-			Questions: SurveyQuestionMap,
+	for key, answer := range document.Answers {
+		field := "answers." + key
+		question, ok := questionnaire.Questions[key]
+		if !ok {
+			errors = append(errors, FieldError{Field: field, Message: "unknown question"})
+			continue
+		}
+		if question.State != "active" {
+			errors = append(errors, FieldError{Field: field, Message: "question is retired"})
+			continue
+		}
+		if !questionnaire.isApplicable(key, document.Answers) {
+			errors = append(errors, FieldError{Field: field,
+				Message: fmt.Sprintf("question is not applicable unless %s is one of %v",
+					question.ShowIf.Question, question.ShowIf.Options)})
+			continue
+		}
+		if answer.Type != question.Type {
+			errors = append(errors, FieldError{Field: field + ".type",
+				Message: fmt.Sprintf("type should be %s", question.Type)})
+			continue
+		}
+
+		switch question.Type {
+		case "selection":
+			if !slices.Contains(question.Options, answer.Option) {
+				errors = append(errors, FieldError{Field: field + ".option",
+					Message: fmt.Sprintf("option %s is not in %v", answer.Option, question.Options)})
+			}
+			if answer.Text != "" {
+				errors = append(errors, FieldError{Field: field + ".text",
+					Message: "text is not allowed for selection question"})
+			}
+		case "text":
+			if answer.Option != "" {
+				errors = append(errors, FieldError{Field: field + ".option",
+					Message: "option is not allowed for text question"})
+			}
+			// Count characters instead of bytes as most of texts are Korean
+			if utf8.RuneCountInString(answer.Text) > question.MaxTextLength {
+				errors = append(errors, FieldError{Field: field + ".text",
+					Message: fmt.Sprintf("text is longer than %d", question.MaxTextLength)})
+			}
 		}
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		json.NewEncoder(w).Encode(response)
 	}
+
+	return errors
 }
 
 func handlePostSurveyAnswer(surveyCollection *mongo.Collection,
-	userCollection *mongo.Collection) http.HandlerFunc {
+	userCollection *mongo.Collection,
+	hospitalCollection *mongo.Collection,
+	questionCollection *mongo.Collection,
+	tipCollection *mongo.Collection,
+	summaryCollection *mongo.Collection,
+	activityCollection *mongo.Collection) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
@@ -205,7 +289,12 @@ func handlePostSurveyAnswer(surveyCollection *mongo.Collection,
 		}
 
 		if surveyCollection.Name() != SurveyCollectionName ||
-			userCollection.Name() != UserCollectionName {
+			userCollection.Name() != UserCollectionName ||
+			hospitalCollection.Name() != HospitalCollectionName ||
+			questionCollection.Name() != SurveyQuestionCollectionName ||
+			tipCollection.Name() != SurveyTipCollectionName ||
+			summaryCollection.Name() != SurveySummaryCollectionName ||
+			activityCollection.Name() != ActivityEventCollectionName {
 			log.Println("Wrong collection is assigned")
 			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
 			return
@@ -219,25 +308,102 @@ func handlePostSurveyAnswer(surveyCollection *mongo.Collection,
 			return
 		}
 
+		questionnaire, err := getLatestSurveyQuestionnaire(questionCollection)
+		if err != nil {
+			http.Error(w, "Error while finding survey questionnaire", http.StatusInternalServerError)
+			log.Println("Failed to find survey questionnaire: " + err.Error())
+			return
+		}
+
+		// Validate answers against the questions
+		fieldErrors := validateSurveyAnswerDocument(surveyReq, questionnaire)
+		if len(fieldErrors) == 0 {
+			found, err := checkHospitalExists(hospitalCollection, surveyReq.HospitalId)
+			if err != nil {
+				http.Error(w, "Error while finding hospital", http.StatusInternalServerError)
+				log.Println("Failed to find hospital " + surveyReq.HospitalId + ": " + err.Error())
+				return
+			}
+			if !found {
+				fieldErrors = append(fieldErrors, FieldError{Field: "hospitalId",
+					Message: "hospital does not exist"})
+			}
+		}
+		if len(fieldErrors) > 0 {
+			writeFieldErrors(w, fieldErrors)
+			return
+		}
+
+		// Stamp the submission time and the questionnaire version that the answers are based on
+		surveyReq.Timestamp = newTimestamp()
+		surveyReq.QuestionnaireVersion = questionnaire.Version
+
+		// Weight of the answers in summaries and scores
+		surveyReq.Trust = getSubmissionTrust(userCollection, surveyCollection, surveyReq.UserId)
+
 		// Define the filter for the document to update or insert
 		filter := bson.M{"hospitalId": surveyReq.HospitalId, "userId": surveyReq.UserId}
 
-		// Update or insert the document
-		update := bson.M{"$set": surveyReq}
-		opts := options.Update().SetUpsert(true) // Set the Upsert option
+		// Update or insert the document, and get the previous one to update the summary
+		opts := options.FindOneAndUpdate().
+			SetUpsert(true). // Set the Upsert option
+			SetReturnDocument(options.Before)
+
+		// The survey, its tips, the summary and the user activity are written together
+		isNew := false
+		hidden := false
+		err = runInTransaction(surveyCollection.Database().Client(), func(ctx context.Context) error {
+			// Moderate texts before saving, so that personal info is not stored
+			document, err := recordSurveyTips(ctx, tipCollection, surveyReq, questionnaire,
+				surveyReq.Timestamp.String())
+			if err != nil {
+				return err
+			}
+
+			var previous SurveyAnswerDocument
+			update := bson.M{"$set": document}
+			err = surveyCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&previous)
+			isNew = err == mongo.ErrNoDocuments
+			if err != nil && !isNew {
+				return err
+			}
+			hidden = previous.Hidden
+
+			// Update the summary with the difference
+			// Hidden surveys stay hidden until the reports are dismissed
+			if previous.Hidden {
+				if !setSurveyTipsHidden(ctx, tipCollection, surveyReq.HospitalId, surveyReq.UserId, true) {
+					return fmt.Errorf("failed to hide survey tips of %s", surveyReq.HospitalId)
+				}
+			} else {
+				var before *SurveyAnswerDocument
+				if !isNew {
+					before = &previous
+				}
+				if !updateSurveySummary(ctx, summaryCollection, surveyReq.HospitalId, before, &document) {
+					return fmt.Errorf("failed to update survey summary of %s", surveyReq.HospitalId)
+				}
+			}
 
-		result, err := surveyCollection.UpdateOne(context.Background(), filter, update, opts)
+			// Record user activity
+			if !recordUserSurvey(ctx, userCollection, surveyReq.UserId, surveyReq.HospitalId) {
+				return fmt.Errorf("failed to record survey to user %s", surveyReq.UserId)
+			}
+			return nil
+		})
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			log.Println("Failed to save or update survey answer: " + err.Error())
 			return
 		}
 
-		// Record user activity
-		recordUserSurvey(userCollection, surveyReq.UserId, surveyReq.HospitalId)
+		// Hidden surveys don't count for trending
+		if !hidden {
+			recordActivityEvent(activityCollection, surveyReq.HospitalId, surveyReq.UserId, ActivityTypeSurvey)
+		}
 
 		// Check if a new document was inserted
-		if result.UpsertedCount > 0 {
+		if isNew {
 			w.WriteHeader(http.StatusCreated) // 201 Created for a new document
 		} else {
 			w.WriteHeader(http.StatusOK) // 200 OK for an update
@@ -246,6 +412,94 @@ func handlePostSurveyAnswer(surveyCollection *mongo.Collection,
 	}
 }
 
+// Remove the survey of the user with its tips, and subtract it from the summary.
+// Returns false if the user has no survey for the hospital.
+func deleteSurveyAnswer(ctx context.Context, surveyCollection *mongo.Collection,
+	tipCollection *mongo.Collection,
+	summaryCollection *mongo.Collection,
+	hospitalId string, userId string) (bool, error) {
+	if surveyCollection.Name() != SurveyCollectionName {
+		return false, fmt.Errorf("got wrong collection: %s", surveyCollection.Name())
+	}
+
+	// Get the removed one to update the summary
+	var previous SurveyAnswerDocument
+	filter := bson.M{"hospitalId": hospitalId, "userId": userId}
+	err := surveyCollection.FindOneAndDelete(ctx, filter).Decode(&previous)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if !previous.Hidden && !updateSurveySummary(ctx, summaryCollection, hospitalId, &previous, nil) {
+		return false, fmt.Errorf("failed to update survey summary of %s", hospitalId)
+	}
+
+	_, err = deleteUserSurveyTips(ctx, tipCollection, userId, hospitalId)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func handleDeleteSurveyAnswer(surveyCollection *mongo.Collection,
+	userCollection *mongo.Collection,
+	tipCollection *mongo.Collection,
+	summaryCollection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Only DELETE method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if surveyCollection.Name() != SurveyCollectionName ||
+			userCollection.Name() != UserCollectionName ||
+			tipCollection.Name() != SurveyTipCollectionName ||
+			summaryCollection.Name() != SurveySummaryCollectionName {
+			log.Println("Wrong collection is assigned")
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+
+		hospitalId := r.URL.Query().Get("hospitalId")
+		if hospitalId == "" {
+			http.Error(w, "hospitalId is empty", http.StatusBadRequest)
+			return
+		}
+		userId := r.URL.Query().Get("userId")
+		if userId == "" {
+			http.Error(w, "userId is empty", http.StatusBadRequest)
+			return
+		}
+
+		// The survey, the summary and the user activity are written together
+		found := false
+		err := runInTransaction(surveyCollection.Database().Client(), func(ctx context.Context) error {
+			var err error
+			found, err = deleteSurveyAnswer(ctx, surveyCollection, tipCollection, summaryCollection, hospitalId, userId)
+			if err != nil || !found {
+				return err
+			}
+			if !removeUserSurvey(ctx, userCollection, userId, hospitalId) {
+				return fmt.Errorf("failed to remove survey from user %s", userId)
+			}
+			return nil
+		})
+		if err != nil {
+			http.Error(w, "Error while deleting survey answer", http.StatusInternalServerError)
+			log.Println("Failed to delete survey answer of " + hospitalId + " for " + userId + ": " + err.Error())
+			return
+		}
+		if !found {
+			http.Error(w, "Survey answer not found", http.StatusNotFound)
+			return
+		}
+
+		fmt.Fprintf(w, "Survey deleted")
+	}
+}
+
 func handleGetSurveyAnswer(collection *mongo.Collection) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
@@ -286,20 +540,10 @@ func handleGetSurveyAnswer(collection *mongo.Collection) http.HandlerFunc {
 	}
 }
 
-func makeSurveySummaryPipelineEntries(key string, question SurveyQuestion) ([]string, []bson.D) {
-	keys := []string{}
-	entries := []bson.D{}
-	for _, option := range question.Options {
-		keys = append(keys, key+"?"+option)
-		entries = append(entries, bson.D{{Key: "$sum",
-			Value: bson.D{{Key: "$cond",
-				Value: bson.A{bson.D{{Key: "$eq",
-					Value: bson.A{"$answers." + key + ".option", option}}}, 1, 0}}}}})
-	}
-	return keys, entries
-}
-
-func handleGetSurveySummary(collection *mongo.Collection) http.HandlerFunc {
+func handleGetSurveySummary(surveyCollection *mongo.Collection,
+	summaryCollection *mongo.Collection,
+	questionCollection *mongo.Collection,
+	tipCollection *mongo.Collection) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		begin := time.Now()
 
@@ -308,8 +552,11 @@ func handleGetSurveySummary(collection *mongo.Collection) http.HandlerFunc {
 			return
 		}
 
-		if collection.Name() != SurveyCollectionName {
-			log.Printf("Got wrong collection: %s", collection.Name())
+		if surveyCollection.Name() != SurveyCollectionName ||
+			summaryCollection.Name() != SurveySummaryCollectionName ||
+			questionCollection.Name() != SurveyQuestionCollectionName ||
+			tipCollection.Name() != SurveyTipCollectionName {
+			log.Println("Wrong collection is assigned")
 			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
 			return
 		}
@@ -319,96 +566,266 @@ func handleGetSurveySummary(collection *mongo.Collection) http.HandlerFunc {
 			http.Error(w, "hospitalId is empty", http.StatusBadRequest)
 			return
 		}
+		since, err := getSinceParam(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		// Define the aggregation pipeline for selection option counting
-		searchKeys := []string{}
-		groupStage := bson.D{
-			{Key: "_id", Value: nil},                                    // Group all documents together
-			{Key: "totalCount", Value: bson.D{{Key: "$sum", Value: 1}}}, // Count total surveys
+		questionnaire, err := getLatestSurveyQuestionnaire(questionCollection)
+		if err != nil {
+			log.Println("Error finding survey questionnaire: " + err.Error())
+			http.Error(w, "Error while finding survey questionnaire", http.StatusInternalServerError)
+			return
+		}
+
+		// Get the summary maintained on each submission,
+		// or count surveys in the time window if requested
+		var document SurveySummaryDocument
+		if since.IsZero() {
+			document, err = getSurveySummaryDocument(summaryCollection, hospitalId)
+		} else {
+			document, err = aggregateSurveySummary(surveyCollection, hospitalId, since)
 		}
-		for key, question := range SurveyQuestionMap {
-			if question.Type != "selection" {
+		if err != nil {
+			log.Println("Error finding survey summary: " + err.Error())
+			http.Error(w, "Error while finding survey summary", http.StatusInternalServerError)
+			return
+		}
+
+		response := newSurveySummaryResponse(document, questionnaire, since)
+
+		// Add the first page of approved tips for text questions
+		for key, question := range questionnaire.activeQuestions() {
+			if question.Type != "text" {
+				continue
+			}
+			tips, tipCount, err := getApprovedSurveyTips(tipCollection, hospitalId, key, 1)
+			if err != nil {
+				log.Println("Survey summary tip error: " + err.Error())
 				continue
 			}
-			keys, entries := makeSurveySummaryPipelineEntries(key, question)
-			searchKeys = append(searchKeys, keys...)
-			for i := 0; i < len(keys); i++ {
-				groupStage = append(groupStage, bson.E{Key: keys[i], Value: entries[i]})
+			summary := SurveySummary{
+				Type:          "text",
+				Options:       []string{},
+				OptionCounts:  []int{},
+				OptionWeights: []float64{},
+				Texts:         []string{},
+				Tips:          tips,
+				TipCount:      int(tipCount),
 			}
+			for _, tip := range tips {
+				summary.Texts = append(summary.Texts, tip.Text)
+			}
+			response.Summaries[key] = summary
+		}
+
+		// Respond with the survey answer
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+
+		profilePerformance(ProfileKeyGetSurveySummary, begin)
+	}
+}
+
+// Summaries of selection questions. Answers of retired questions are not summarized.
+func newSurveySummaryResponse(document SurveySummaryDocument,
+	questionnaire SurveyQuestionnaireDocument, since time.Time) SurveySummaryResponse {
+	response := SurveySummaryResponse{
+		HospitalId: document.HospitalId,
+		TotalCount: document.TotalCount,
+		Summaries:  map[string]SurveySummary{},
+	}
+	if !since.IsZero() {
+		response.Since = since.Format(TimestampFormat)
+	}
+	if document.TotalCount == 0 {
+		return response
+	}
+
+	for key, question := range questionnaire.activeQuestions() {
+		if question.Type != "selection" {
+			continue
+		}
+		summary := SurveySummary{
+			Type:          "selection",
+			Options:       []string{},
+			OptionCounts:  []int{},
+			OptionWeights: []float64{},
+		}
+		weights := document.getWeightedCounts()
+		for _, option := range question.Options {
+			summary.Options = append(summary.Options, option)
+			summary.OptionCounts = append(summary.OptionCounts, document.Counts[key][option])
+			summary.OptionWeights = append(summary.OptionWeights, weights[key][option])
+			summary.AnswerCount += document.Counts[key][option]
 		}
-		pipeline := mongo.Pipeline{
-			bson.D{{Key: "$match", Value: bson.D{{Key: "hospitalId", Value: hospitalId}}}},
-			bson.D{{Key: "$group", Value: groupStage}},
+		// Baselines are computed from all-time summaries
+		if since.IsZero() {
+			summary.Benchmark = getSurveyBenchmark(document, key, question.Options)
 		}
+		response.Summaries[key] = summary
+	}
+	return response
+}
 
-		// Perform the aggregation
-		cursor, err := collection.Aggregate(context.Background(), pipeline)
+// Selection summaries of multiple hospitals for list views, without tips
+func handlePostSurveySummaries(surveyCollection *mongo.Collection,
+	summaryCollection *mongo.Collection,
+	questionCollection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		begin := time.Now()
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if surveyCollection.Name() != SurveyCollectionName ||
+			summaryCollection.Name() != SurveySummaryCollectionName ||
+			questionCollection.Name() != SurveyQuestionCollectionName {
+			log.Println("Wrong collection is assigned")
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+
+		var request SurveySummariesRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
 		if err != nil {
-			log.Println("Survey summary aggregation error: " + err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Println("Failed to decode survey summaries request: " + err.Error())
+			return
+		}
+		if len(request.HospitalIds) == 0 {
+			writeFieldErrors(w, []FieldError{{Field: "hospitalIds", Message: "hospitalIds are empty"}})
+			return
+		}
+		if len(request.HospitalIds) > SurveySummaryBatchLimit {
+			writeFieldErrors(w, []FieldError{{Field: "hospitalIds",
+				Message: fmt.Sprintf("hospitalIds should not be more than %d", SurveySummaryBatchLimit)}})
+			return
+		}
+		since, err := getSinceParam(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-		defer cursor.Close(context.Background())
 
-		// Decode result
-		var result bson.M
-		for cursor.Next(context.Background()) {
-			err = cursor.Decode(&result)
-			if err != nil {
-				log.Println("Survey summary cursor decode error: " + err.Error())
-			}
+		questionnaire, err := getLatestSurveyQuestionnaire(questionCollection)
+		if err != nil {
+			log.Println("Error finding survey questionnaire: " + err.Error())
+			http.Error(w, "Error while finding survey questionnaire", http.StatusInternalServerError)
+			return
+		}
+
+		// Same as the single summary, count surveys only if the time window is requested
+		var documents map[string]SurveySummaryDocument
+		if since.IsZero() {
+			documents, err = getSurveySummaryDocuments(summaryCollection, request.HospitalIds)
+		} else {
+			documents, err = aggregateSurveySummaries(surveyCollection, request.HospitalIds, since)
+		}
+		if err != nil {
+			log.Println("Error finding survey summaries: " + err.Error())
+			http.Error(w, "Error while finding survey summaries", http.StatusInternalServerError)
+			return
 		}
 
-		response := SurveySummaryResponse{
+		response := map[string]SurveySummaryResponse{}
+		for hospitalId, document := range documents {
+			response[hospitalId] = newSurveySummaryResponse(document, questionnaire, since)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+
+		profilePerformance(ProfileKeyGetSurveySummaries, begin)
+	}
+}
+
+func handleGetSurveyTrend(surveyCollection *mongo.Collection,
+	questionCollection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if surveyCollection.Name() != SurveyCollectionName ||
+			questionCollection.Name() != SurveyQuestionCollectionName {
+			log.Println("Wrong collection is assigned")
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+
+		hospitalId := r.URL.Query().Get("hospitalId")
+		if hospitalId == "" {
+			http.Error(w, "hospitalId is empty", http.StatusBadRequest)
+			return
+		}
+		questionKey := r.URL.Query().Get("question")
+		if questionKey == "" {
+			http.Error(w, "question is empty", http.StatusBadRequest)
+			return
+		}
+		since, err := getSinceParam(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		questionnaire, err := getLatestSurveyQuestionnaire(questionCollection)
+		if err != nil {
+			log.Println("Error finding survey questionnaire: " + err.Error())
+			http.Error(w, "Error while finding survey questionnaire", http.StatusInternalServerError)
+			return
+		}
+		question, ok := questionnaire.Questions[questionKey]
+		if !ok || question.Type != "selection" {
+			http.Error(w, "question is not a selection question", http.StatusBadRequest)
+			return
+		}
+
+		monthCounts, err := aggregateSurveyTrend(surveyCollection, hospitalId, questionKey, since)
+		if err != nil {
+			log.Println("Survey trend aggregation error: " + err.Error())
+			http.Error(w, "Error while aggregating survey trend", http.StatusInternalServerError)
+			return
+		}
+
+		response := SurveyTrendResponse{
 			HospitalId: hospitalId,
-			TotalCount: 0,
-			Summaries:  map[string]SurveySummary{},
+			Question:   questionKey,
+			Options:    question.Options,
+			Months:     []SurveyTrendMonth{},
 		}
 
-		if len(result) > 0 {
-			totalCount32, ok := result["totalCount"].(int32)
-			if !ok {
-				log.Println("Survey summary total count is not integer: ", totalCount32)
-				totalCount32 = 0
-			}
-			response.TotalCount = int(totalCount32)
-
-			for _, key := range searchKeys {
-				// Currently, the value should be always integer
-				int32Val, ok := result[key].(int32)
-				if !ok {
-					log.Println("Survey summary value is not integer: ", key, result[key])
-					continue
-				}
-				intVal := int(int32Val)
-				split := strings.Split(key, "?")
-				if len(split) != 2 {
-					log.Println("Survey summary key format is wrong: ", key)
-					continue
+		// Fill months without surveys between the first and the last month
+		months := []string{}
+		for month := range monthCounts {
+			months = append(months, month)
+		}
+		slices.Sort(months)
+		if len(months) > 0 {
+			first, _ := time.ParseInLocation("2006-01", months[0], time.Local)
+			last, _ := time.ParseInLocation("2006-01", months[len(months)-1], time.Local)
+			for month := first; !month.After(last); month = month.AddDate(0, 1, 0) {
+				key := month.Format("2006-01")
+				trendMonth := SurveyTrendMonth{
+					Month:        key,
+					TotalCount:   0,
+					OptionCounts: []int{},
 				}
-				question := split[0]
-				option := split[1]
-
-				// Get summary
-				summary, ok := response.Summaries[question]
-				if !ok {
-					summary = SurveySummary{
-						Type:         "selection",
-						Options:      []string{},
-						OptionCounts: []int{},
-					}
-					response.Summaries[question] = summary
+				for _, option := range question.Options {
+					count := monthCounts[key][option]
+					trendMonth.OptionCounts = append(trendMonth.OptionCounts, count)
+					trendMonth.TotalCount += count
 				}
-
-				// Set option count
-				summary.Options = append(summary.Options, option)
-				summary.OptionCounts = append(summary.OptionCounts, intVal)
-				response.Summaries[question] = summary
+				response.Months = append(response.Months, trendMonth)
 			}
 		}
 
-		// Respond with the survey answer
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
-
-		profilePerformance(ProfileKeyGetSurveySummary, begin)
 	}
 }
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Report of a survey answer by another user
+type SurveyReportDocument struct {
+	Id                primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	HospitalId        string             `bson:"hospitalId" json:"hospitalId"`
+	UserId            string             `bson:"userId" json:"userId"` // Author of the reported survey
+	ReporterId        string             `bson:"reporterId" json:"reporterId"`
+	Reason            string             `bson:"reason" json:"reason"`
+	Comment           string             `bson:"comment" json:"comment"`
+	State             string             `bson:"state" json:"state"` // "open", "upheld", "dismissed"
+	Timestamp         string             `bson:"timestamp" json:"timestamp"`
+	ResolvedTimestamp string             `bson:"resolvedTimestamp" json:"resolvedTimestamp"`
+}
+
+// Audit trail of moderation actions on survey answers
+type ModerationLogDocument struct {
+	Id          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	HospitalId  string             `bson:"hospitalId" json:"hospitalId"`
+	UserId      string             `bson:"userId" json:"userId"`
+	Action      string             `bson:"action" json:"action"` // "hide", "uphold", "dismiss"
+	ModeratorId string             `bson:"moderatorId" json:"moderatorId"`
+	Note        string             `bson:"note" json:"note"`
+	ReportCount int64              `bson:"reportCount" json:"reportCount"` // Open reports at the time of the action
+	Timestamp   string             `bson:"timestamp" json:"timestamp"`
+}
+
+type SurveyReportPostRequest struct {
+	TipId      string `json:"tipId"` // Any tip of the reported survey answer
+	ReporterId string `json:"reporterId"`
+	Reason     string `json:"reason"`
+	Comment    string `json:"comment"`
+}
+
+type SurveyReportResolveRequest struct {
+	HospitalId  string `json:"hospitalId"`
+	UserId      string `json:"userId"`
+	Action      string `json:"action"`      // "uphold", "dismiss"
+	ModeratorId string `json:"moderatorId"` // Set to the admin name of the admin key
+	Note        string `json:"note"`
+}
+
+type SurveyReportListResponse struct {
+	Reports       []SurveyReportDocument `json:"reports"`
+	TotalCount    int32                  `json:"totalCount"`
+	PageableCount int32                  `json:"pageableCount"`
+}
+
+type ModerationLogListResponse struct {
+	Logs          []ModerationLogDocument `json:"logs"`
+	TotalCount    int32                   `json:"totalCount"`
+	PageableCount int32                   `json:"pageableCount"`
+}
+
+var SurveyReportReasons = []string{"fake", "abusive", "spam", "other"}
+
+func ensureSurveyReportCollectionIndex(collection *mongo.Collection) bool {
+	if collection.Name() != SurveyReportCollectionName {
+		log.Printf("Got wrong collection: %s", collection.Name())
+		return false
+	}
+
+	indexModels := []mongo.IndexModel{
+		// One report per reporter of a user survey
+		{
+			Keys: bson.D{
+				{Key: "hospitalId", Value: 1}, // 1 for ascending order
+				{Key: "userId", Value: 1},
+				{Key: "reporterId", Value: 1},
+			},
+			Options: options.Index().SetUnique(true),
+		},
+		// Listing reports to review
+		{
+			Keys: bson.D{
+				{Key: "state", Value: 1},
+				{Key: "timestamp", Value: 1},
+			},
+		},
+	}
+
+	_, err := collection.Indexes().CreateMany(context.Background(), indexModels)
+	if err != nil {
+		log.Println("Could not create index in survey report collection: " + err.Error())
+		return false
+	}
+	log.Println("Survey report collection index created successfully")
+	return true
+}
+
+// Hide or show the survey answer, and update the summary and the tips accordingly in a transaction.
+// Returns false if the answer doesn't exist or is already in the state.
+func setSurveyAnswerHidden(surveyCollection *mongo.Collection,
+	tipCollection *mongo.Collection,
+	summaryCollection *mongo.Collection,
+	hospitalId string, userId string, hidden bool) (bool, error) {
+	if surveyCollection.Name() != SurveyCollectionName {
+		return false, fmt.Errorf("got wrong collection: %s", surveyCollection.Name())
+	}
+
+	filter := bson.M{"hospitalId": hospitalId, "userId": userId}
+	var update bson.M
+	if hidden {
+		filter["hidden"] = bson.M{"$ne": true}
+		update = bson.M{"$set": bson.M{"hidden": true}}
+	} else {
+		filter["hidden"] = true
+		update = bson.M{"$unset": bson.M{"hidden": ""}}
+	}
+
+	changed := false
+	err := runInTransaction(surveyCollection.Database().Client(), func(ctx context.Context) error {
+		var document SurveyAnswerDocument
+		err := surveyCollection.FindOneAndUpdate(ctx, filter, update).Decode(&document)
+		if err == mongo.ErrNoDocuments {
+			changed = false
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		success := false
+		if hidden {
+			success = updateSurveySummary(ctx, summaryCollection, hospitalId, &document, nil)
+		} else {
+			success = updateSurveySummary(ctx, summaryCollection, hospitalId, nil, &document)
+		}
+		if !success {
+			return fmt.Errorf("failed to update survey summary of %s", hospitalId)
+		}
+		if !setSurveyTipsHidden(ctx, tipCollection, hospitalId, userId, hidden) {
+			return fmt.Errorf("failed to update survey tips of %s", hospitalId)
+		}
+		changed = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return changed, nil
+}
+
+func recordModerationLog(collection *mongo.Collection, document ModerationLogDocument) bool {
+	if collection.Name() != ModerationLogCollectionName {
+		log.Printf("Got wrong collection: %s", collection.Name())
+		return false
+	}
+
+	document.Timestamp = time.Now().Format(TimestampFormat)
+	_, err := collection.InsertOne(context.Background(), document)
+	if err != nil {
+		log.Println("Failed to record moderation log of " + document.HospitalId +
+			" for " + document.UserId + ": " + err.Error())
+		return false
+	}
+	return true
+}
+
+func countOpenSurveyReports(collection *mongo.Collection, hospitalId string, userId string) (int64, error) {
+	return collection.CountDocuments(context.Background(),
+		bson.M{"hospitalId": hospitalId, "userId": userId, "state": "open"})
+}
+
+func handlePostSurveyReport(surveyCollection *mongo.Collection,
+	tipCollection *mongo.Collection,
+	summaryCollection *mongo.Collection,
+	reportCollection *mongo.Collection,
+	logCollection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if surveyCollection.Name() != SurveyCollectionName ||
+			tipCollection.Name() != SurveyTipCollectionName ||
+			summaryCollection.Name() != SurveySummaryCollectionName ||
+			reportCollection.Name() != SurveyReportCollectionName ||
+			logCollection.Name() != ModerationLogCollectionName {
+			log.Println("Wrong collection is assigned")
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+
+		var request SurveyReportPostRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Println("Failed to decode survey report post request: " + err.Error())
+			return
+		}
+
+		fieldErrors := []FieldError{}
+		tipId, err := primitive.ObjectIDFromHex(request.TipId)
+		if err != nil {
+			fieldErrors = append(fieldErrors, FieldError{Field: "tipId", Message: "tipId is not valid"})
+		}
+		if request.ReporterId == "" {
+			fieldErrors = append(fieldErrors, FieldError{Field: "reporterId", Message: "reporterId is empty"})
+		}
+		if !slices.Contains(SurveyReportReasons, request.Reason) {
+			fieldErrors = append(fieldErrors, FieldError{Field: "reason",
+				Message: fmt.Sprintf("reason should be one of %v", SurveyReportReasons)})
+		}
+		if len(fieldErrors) > 0 {
+			writeFieldErrors(w, fieldErrors)
+			return
+		}
+
+		// Find the survey answer of the tip, as authors are not exposed to clients
+		var tip SurveyTipDocument
+		err = tipCollection.FindOne(context.Background(), bson.M{"_id": tipId}).Decode(&tip)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Survey tip not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Println("Failed to find survey tip " + request.TipId + ": " + err.Error())
+			return
+		}
+		if tip.UserId == request.ReporterId {
+			writeFieldErrors(w, []FieldError{{Field: "reporterId",
+				Message: "users can not report their own survey"}})
+			return
+		}
+		hospitalId := tip.HospitalId
+		userId := tip.UserId
+
+		// A reporter can report a survey only once
+		filter := bson.M{
+			"hospitalId": hospitalId,
+			"userId":     userId,
+			"reporterId": request.ReporterId,
+		}
+		update := bson.M{"$setOnInsert": SurveyReportDocument{
+			HospitalId: hospitalId,
+			UserId:     userId,
+			ReporterId: request.ReporterId,
+			Reason:     request.Reason,
+			Comment:    moderateText(request.Comment).Text,
+			State:      "open",
+			Timestamp:  time.Now().Format(TimestampFormat),
+		}}
+		result, err := reportCollection.UpdateOne(context.Background(), filter, update,
+			options.Update().SetUpsert(true))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Println("Failed to save survey report: " + err.Error())
+			return
+		}
+		if result.UpsertedCount == 0 {
+			fmt.Fprintf(w, "Survey already reported")
+			return
+		}
+
+		// Hide the answer until reviewed if it is reported by many users
+		count, err := countOpenSurveyReports(reportCollection, hospitalId, userId)
+		if err != nil {
+			log.Println("Failed to count survey reports: " + err.Error())
+		} else if count >= SurveyReportHideThreshold {
+			hidden, err := setSurveyAnswerHidden(surveyCollection, tipCollection, summaryCollection,
+				hospitalId, userId, true)
+			if err != nil {
+				log.Println("Failed to hide reported survey answer: " + err.Error())
+			} else if hidden {
+				recordModerationLog(logCollection, ModerationLogDocument{
+					HospitalId:  hospitalId,
+					UserId:      userId,
+					Action:      "hide",
+					ModeratorId: "system",
+					Note:        "Reached the report threshold",
+					ReportCount: count,
+				})
+			}
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "Survey reported")
+	}
+}
+
+func handleGetSurveyReports(collection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if collection.Name() != SurveyReportCollectionName {
+			log.Printf("Got wrong collection: %s", collection.Name())
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+
+		state := r.URL.Query().Get("state")
+		if state == "" {
+			state = "open"
+		}
+		page, err := getPageParam(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		filter := bson.M{"state": state}
+		totalCount, err := collection.CountDocuments(context.Background(), filter)
+		if err != nil {
+			log.Println("Error in handleGetSurveyReports: CountDocuments: " + err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		documents := []SurveyReportDocument{}
+		if totalCount > 0 {
+			// Oldest first to review in reported order
+			findOptions := options.Find()
+			findOptions.SetSort(bson.D{{Key: "timestamp", Value: 1}})
+			findOptions.SetSkip((page - 1) * SurveyReportPageableCount)
+			findOptions.SetLimit(SurveyReportPageableCount)
+
+			cursor, err := collection.Find(context.Background(), filter, findOptions)
+			if err != nil {
+				log.Println("Error in handleGetSurveyReports: collection.Find: " + err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer cursor.Close(context.Background())
+
+			if err = cursor.All(context.Background(), &documents); err != nil {
+				log.Println("Error in handleGetSurveyReports: cursor.All: " + err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		response := SurveyReportListResponse{
+			Reports:       documents,
+			TotalCount:    int32(totalCount),
+			PageableCount: int32(len(documents)),
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// Resolve all open reports of a survey answer.
+// Upheld answers are hidden, and dismissed answers are shown again.
+func handlePostSurveyReportResolve(surveyCollection *mongo.Collection,
+	tipCollection *mongo.Collection,
+	summaryCollection *mongo.Collection,
+	reportCollection *mongo.Collection,
+	logCollection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if surveyCollection.Name() != SurveyCollectionName ||
+			tipCollection.Name() != SurveyTipCollectionName ||
+			summaryCollection.Name() != SurveySummaryCollectionName ||
+			reportCollection.Name() != SurveyReportCollectionName ||
+			logCollection.Name() != ModerationLogCollectionName {
+			log.Println("Wrong collection is assigned")
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+
+		var request SurveyReportResolveRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Println("Failed to decode survey report resolve request: " + err.Error())
+			return
+		}
+
+		fieldErrors := []FieldError{}
+		if request.HospitalId == "" {
+			fieldErrors = append(fieldErrors, FieldError{Field: "hospitalId", Message: "hospitalId is empty"})
+		}
+		if request.UserId == "" {
+			fieldErrors = append(fieldErrors, FieldError{Field: "userId", Message: "userId is empty"})
+		}
+		if request.ModeratorId == "" {
+			fieldErrors = append(fieldErrors, FieldError{Field: "moderatorId", Message: "moderatorId is empty"})
+		}
+		state := ""
+		switch request.Action {
+		case "uphold":
+			state = "upheld"
+		case "dismiss":
+			state = "dismissed"
+		default:
+			fieldErrors = append(fieldErrors, FieldError{Field: "action",
+				Message: "action should be uphold or dismiss"})
+		}
+		if len(fieldErrors) > 0 {
+			writeFieldErrors(w, fieldErrors)
+			return
+		}
+
+		filter := bson.M{"hospitalId": request.HospitalId, "userId": request.UserId, "state": "open"}
+		update := bson.M{"$set": bson.M{
+			"state":             state,
+			"resolvedTimestamp": time.Now().Format(TimestampFormat),
+		}}
+		result, err := reportCollection.UpdateMany(context.Background(), filter, update)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Println("Failed to resolve survey reports: " + err.Error())
+			return
+		}
+		if result.MatchedCount == 0 {
+			http.Error(w, "No open reports found", http.StatusNotFound)
+			return
+		}
+
+		_, err = setSurveyAnswerHidden(surveyCollection, tipCollection, summaryCollection,
+			request.HospitalId, request.UserId, request.Action == "uphold")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Println("Failed to update reported survey answer: " + err.Error())
+			return
+		}
+
+		recordModerationLog(logCollection, ModerationLogDocument{
+			HospitalId:  request.HospitalId,
+			UserId:      request.UserId,
+			Action:      request.Action,
+			ModeratorId: request.ModeratorId,
+			Note:        request.Note,
+			ReportCount: result.ModifiedCount,
+		})
+
+		log.Printf("Reports of survey %s by %s are %s", request.HospitalId, request.UserId, state)
+		fmt.Fprintf(w, "Survey reports resolved")
+	}
+}
+
+func handleGetModerationLogs(collection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if collection.Name() != ModerationLogCollectionName {
+			log.Printf("Got wrong collection: %s", collection.Name())
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+
+		page, err := getPageParam(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		filter := bson.M{}
+		if hospitalId := r.URL.Query().Get("hospitalId"); hospitalId != "" {
+			filter["hospitalId"] = hospitalId
+		}
+		if userId := r.URL.Query().Get("userId"); userId != "" {
+			filter["userId"] = userId
+		}
+
+		totalCount, err := collection.CountDocuments(context.Background(), filter)
+		if err != nil {
+			log.Println("Error in handleGetModerationLogs: CountDocuments: " + err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		documents := []ModerationLogDocument{}
+		if totalCount > 0 {
+			// Latest first
+			findOptions := options.Find()
+			findOptions.SetSort(bson.D{{Key: "timestamp", Value: -1}})
+			findOptions.SetSkip((page - 1) * SurveyReportPageableCount)
+			findOptions.SetLimit(SurveyReportPageableCount)
+
+			cursor, err := collection.Find(context.Background(), filter, findOptions)
+			if err != nil {
+				log.Println("Error in handleGetModerationLogs: collection.Find: " + err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer cursor.Close(context.Background())
+
+			if err = cursor.All(context.Background(), &documents); err != nil {
+				log.Println("Error in handleGetModerationLogs: cursor.All: " + err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		response := ModerationLogListResponse{
+			Logs:          documents,
+			TotalCount:    int32(totalCount),
+			PageableCount: int32(len(documents)),
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(response)
+	}
+}
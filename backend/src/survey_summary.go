@@ -0,0 +1,544 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Selection option counts of a hospital, maintained on each survey submission
+type SurveySummaryDocument struct {
+	HospitalId string                    `bson:"_id"`
+	TotalCount int                       `bson:"totalCount"`
+	Counts     map[string]map[string]int `bson:"counts"` // Question -> option -> count
+	LastUpdate string                    `bson:"lastUpdate"`
+
+	// Counts weighted by the trust of the authors, for scores
+	TotalWeight float64                       `bson:"totalWeight"`
+	Weights     map[string]map[string]float64 `bson:"weights"` // Question -> option -> weight
+
+	// Refreshed periodically by the score refresher, for sorting hospitals
+	Region          string  `bson:"region,omitempty"`
+	Score           float64 `bson:"score,omitempty"`
+	ScoreConfidence float64 `bson:"scoreConfidence,omitempty"`
+}
+
+func newSurveySummaryDocument(hospitalId string) SurveySummaryDocument {
+	return SurveySummaryDocument{
+		HospitalId: hospitalId,
+		TotalCount: 0,
+		Counts:     map[string]map[string]int{},
+		Weights:    map[string]map[string]float64{},
+	}
+}
+
+// Add or subtract (sign: 1 or -1) selection answers of a survey to the counts
+func (document *SurveySummaryDocument) addAnswers(answers map[string]SurveyAnswer, sign int, trust float64) {
+	for key, answer := range answers {
+		if answer.Type != "selection" || answer.Option == "" {
+			continue
+		}
+		if document.Counts[key] == nil {
+			document.Counts[key] = map[string]int{}
+			document.Weights[key] = map[string]float64{}
+		}
+		document.Counts[key][answer.Option] += sign
+		document.Weights[key][answer.Option] += float64(sign) * trust
+	}
+	document.TotalCount += sign
+	document.TotalWeight += float64(sign) * trust
+}
+
+// Weighted counts for scores. Summaries built before trust scores have plain counts only.
+func (document SurveySummaryDocument) getWeightedCounts() map[string]map[string]float64 {
+	if document.TotalWeight > 0 || document.TotalCount == 0 {
+		return document.Weights
+	}
+	weights := map[string]map[string]float64{}
+	for key, counts := range document.Counts {
+		weights[key] = map[string]float64{}
+		for option, count := range counts {
+			weights[key][option] = float64(count)
+		}
+	}
+	return weights
+}
+
+func (document SurveySummaryDocument) equals(other SurveySummaryDocument) bool {
+	if document.TotalCount != other.TotalCount ||
+		math.Abs(document.TotalWeight-other.TotalWeight) > SurveyWeightTolerance {
+		return false
+	}
+	// Zero counts are same as missing counts
+	for _, pair := range [][2]SurveySummaryDocument{{document, other}, {other, document}} {
+		for key, counts := range pair[0].Counts {
+			for option, count := range counts {
+				if count != pair[1].Counts[key][option] {
+					return false
+				}
+			}
+		}
+		for key, weights := range pair[0].Weights {
+			for option, weight := range weights {
+				if math.Abs(weight-pair[1].Weights[key][option]) > SurveyWeightTolerance {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// Apply the difference between the previous and the new survey of a user to the summary.
+// Previous survey is nil for a new survey, and new survey is nil for a removed survey.
+func updateSurveySummary(ctx context.Context, collection *mongo.Collection, hospitalId string,
+	previous *SurveyAnswerDocument, current *SurveyAnswerDocument) bool {
+	if collection.Name() != SurveySummaryCollectionName {
+		log.Printf("Got wrong collection: %s", collection.Name())
+		return false
+	}
+
+	delta := newSurveySummaryDocument(hospitalId)
+	if previous != nil {
+		delta.addAnswers(previous.Answers, -1, previous.getTrust())
+	}
+	if current != nil {
+		delta.addAnswers(current.Answers, 1, current.getTrust())
+	}
+
+	increments := bson.M{"totalCount": delta.TotalCount, "totalWeight": delta.TotalWeight}
+	for key, counts := range delta.Counts {
+		for option, count := range counts {
+			if count != 0 {
+				increments["counts."+key+"."+option] = count
+			}
+			if weight := delta.Weights[key][option]; weight != 0 {
+				increments["weights."+key+"."+option] = weight
+			}
+		}
+	}
+
+	update := bson.M{
+		"$inc": increments,
+		"$set": bson.M{"lastUpdate": time.Now().Format(TimestampFormat)},
+	}
+	_, err := collection.UpdateOne(ctx, bson.M{"_id": hospitalId},
+		update, options.Update().SetUpsert(true))
+	if err != nil {
+		log.Println("Failed to update survey summary of " + hospitalId + ": " + err.Error())
+		return false
+	}
+	return true
+}
+
+func getSurveySummaryDocument(collection *mongo.Collection, hospitalId string) (SurveySummaryDocument, error) {
+	if collection.Name() != SurveySummaryCollectionName {
+		return SurveySummaryDocument{}, fmt.Errorf("got wrong collection: %s", collection.Name())
+	}
+
+	document := newSurveySummaryDocument(hospitalId)
+	err := collection.FindOne(context.Background(), bson.M{"_id": hospitalId}).Decode(&document)
+	// There is a chance that the document doesn't exist
+	if err != nil && err != mongo.ErrNoDocuments {
+		return SurveySummaryDocument{}, err
+	}
+	if document.Counts == nil {
+		document.Counts = map[string]map[string]int{}
+	}
+	return document, nil
+}
+
+// Count all surveys from the survey collection
+func computeSurveySummaries(surveyCollection *mongo.Collection) (map[string]SurveySummaryDocument, error) {
+	if surveyCollection.Name() != SurveyCollectionName {
+		return nil, fmt.Errorf("got wrong collection: %s", surveyCollection.Name())
+	}
+
+	// Hidden surveys are excluded from summaries
+	cursor, err := surveyCollection.Find(context.Background(), bson.M{"hidden": bson.M{"$ne": true}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	summaries := map[string]SurveySummaryDocument{}
+	for cursor.Next(context.Background()) {
+		var survey SurveyAnswerDocument
+		err = cursor.Decode(&survey)
+		if err != nil {
+			log.Println("Survey cursor decode error: " + err.Error())
+			continue
+		}
+
+		summary, ok := summaries[survey.HospitalId]
+		if !ok {
+			summary = newSurveySummaryDocument(survey.HospitalId)
+		}
+		summary.addAnswers(survey.Answers, 1, survey.getTrust())
+		summaries[survey.HospitalId] = summary
+	}
+	return summaries, nil
+}
+
+// Compare stored summaries with the ones computed from surveys,
+// and returns hospital IDs whose summaries are inconsistent
+func verifySurveySummaries(surveyCollection *mongo.Collection,
+	summaryCollection *mongo.Collection) ([]string, error) {
+	if summaryCollection.Name() != SurveySummaryCollectionName {
+		return nil, fmt.Errorf("got wrong collection: %s", summaryCollection.Name())
+	}
+
+	computed, err := computeSurveySummaries(surveyCollection)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := summaryCollection.Find(context.Background(), bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	stored := map[string]SurveySummaryDocument{}
+	for cursor.Next(context.Background()) {
+		var document SurveySummaryDocument
+		err = cursor.Decode(&document)
+		if err != nil {
+			log.Println("Survey summary cursor decode error: " + err.Error())
+			continue
+		}
+		stored[document.HospitalId] = document
+	}
+
+	mismatches := []string{}
+	for hospitalId, document := range computed {
+		if !document.equals(stored[hospitalId]) {
+			mismatches = append(mismatches, hospitalId)
+		}
+	}
+	for hospitalId, document := range stored {
+		if _, ok := computed[hospitalId]; !ok && !document.equals(newSurveySummaryDocument(hospitalId)) {
+			mismatches = append(mismatches, hospitalId)
+		}
+	}
+	return mismatches, nil
+}
+
+// Recompute the summary of a hospital from its surveys. Only the counts are set,
+// so that the score fields refreshed by the score refresher are kept.
+func rebuildSurveySummary(ctx context.Context, surveyCollection *mongo.Collection,
+	summaryCollection *mongo.Collection, hospitalId string) error {
+	// Hidden surveys are excluded from summaries
+	cursor, err := surveyCollection.Find(ctx, bson.M{"hospitalId": hospitalId, "hidden": bson.M{"$ne": true}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	document := newSurveySummaryDocument(hospitalId)
+	for cursor.Next(ctx) {
+		var survey SurveyAnswerDocument
+		err = cursor.Decode(&survey)
+		if err != nil {
+			log.Println("Survey cursor decode error: " + err.Error())
+			continue
+		}
+		document.addAnswers(survey.Answers, 1, survey.getTrust())
+	}
+
+	update := bson.M{"$set": bson.M{
+		"totalCount":  document.TotalCount,
+		"counts":      document.Counts,
+		"totalWeight": document.TotalWeight,
+		"weights":     document.Weights,
+		"lastUpdate":  time.Now().Format(TimestampFormat),
+	}}
+	_, err = summaryCollection.UpdateOne(ctx, bson.M{"_id": hospitalId}, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// Recompute summaries of the hospitals. Each hospital is recounted in a transaction,
+// so that submissions during the rebuild are not lost.
+func rebuildSurveySummariesOf(surveyCollection *mongo.Collection,
+	summaryCollection *mongo.Collection, hospitalIds []string) (int, error) {
+	if surveyCollection.Name() != SurveyCollectionName {
+		return 0, fmt.Errorf("got wrong collection: %s", surveyCollection.Name())
+	}
+	if summaryCollection.Name() != SurveySummaryCollectionName {
+		return 0, fmt.Errorf("got wrong collection: %s", summaryCollection.Name())
+	}
+
+	client := summaryCollection.Database().Client()
+	for _, hospitalId := range hospitalIds {
+		err := runInTransaction(client, func(ctx context.Context) error {
+			return rebuildSurveySummary(ctx, surveyCollection, summaryCollection, hospitalId)
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to rebuild survey summary of %s: %w", hospitalId, err)
+		}
+	}
+	return len(hospitalIds), nil
+}
+
+// Recompute summaries of all hospitals with surveys or summaries.
+// Summaries of hospitals without surveys are reset to zero counts.
+func rebuildSurveySummaries(surveyCollection *mongo.Collection,
+	summaryCollection *mongo.Collection) (int, error) {
+	if surveyCollection.Name() != SurveyCollectionName {
+		return 0, fmt.Errorf("got wrong collection: %s", surveyCollection.Name())
+	}
+	if summaryCollection.Name() != SurveySummaryCollectionName {
+		return 0, fmt.Errorf("got wrong collection: %s", summaryCollection.Name())
+	}
+
+	surveyed, err := surveyCollection.Distinct(context.Background(), "hospitalId", bson.M{})
+	if err != nil {
+		return 0, err
+	}
+	summarized, err := summaryCollection.Distinct(context.Background(), "_id", bson.M{})
+	if err != nil {
+		return 0, err
+	}
+
+	hospitalIds := []string{}
+	found := map[string]bool{}
+	for _, value := range append(surveyed, summarized...) {
+		hospitalId, ok := value.(string)
+		if ok && !found[hospitalId] {
+			found[hospitalId] = true
+			hospitalIds = append(hospitalIds, hospitalId)
+		}
+	}
+	return rebuildSurveySummariesOf(surveyCollection, summaryCollection, hospitalIds)
+}
+
+// Rebuild summaries built before trust scores, which have counts but no weights.
+// Run before serving, as the first weighted submission would hide the plain counts from scores.
+func backfillSurveySummaryWeights(surveyCollection *mongo.Collection,
+	summaryCollection *mongo.Collection) (int, error) {
+	if summaryCollection.Name() != SurveySummaryCollectionName {
+		return 0, fmt.Errorf("got wrong collection: %s", summaryCollection.Name())
+	}
+
+	values, err := summaryCollection.Distinct(context.Background(), "_id", bson.M{
+		"totalCount":  bson.M{"$gt": 0},
+		"totalWeight": bson.M{"$not": bson.M{"$gt": 0}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	hospitalIds := []string{}
+	for _, value := range values {
+		if hospitalId, ok := value.(string); ok {
+			hospitalIds = append(hospitalIds, hospitalId)
+		}
+	}
+	return rebuildSurveySummariesOf(surveyCollection, summaryCollection, hospitalIds)
+}
+
+// Count surveys of the hospital submitted since the given time, for time-windowed summaries
+// which can not be served from the maintained summary
+func aggregateSurveySummary(surveyCollection *mongo.Collection,
+	hospitalId string, since time.Time) (SurveySummaryDocument, error) {
+	documents, err := aggregateSurveySummaries(surveyCollection, []string{hospitalId}, since)
+	if err != nil {
+		return SurveySummaryDocument{}, err
+	}
+	return documents[hospitalId], nil
+}
+
+// Count surveys of the hospitals submitted since the given time in a single aggregation.
+// Every hospital has a summary in the result, even if it has no surveys.
+func aggregateSurveySummaries(surveyCollection *mongo.Collection,
+	hospitalIds []string, since time.Time) (map[string]SurveySummaryDocument, error) {
+	if surveyCollection.Name() != SurveyCollectionName {
+		return nil, fmt.Errorf("got wrong collection: %s", surveyCollection.Name())
+	}
+
+	documents := map[string]SurveySummaryDocument{}
+	for _, hospitalId := range hospitalIds {
+		documents[hospitalId] = newSurveySummaryDocument(hospitalId)
+	}
+
+	filter := bson.M{
+		"hospitalId": bson.M{"$in": hospitalIds},
+		"hidden":     bson.M{"$ne": true},
+	}
+	if !since.IsZero() {
+		filter["timestamp"] = bson.M{"$gte": since}
+	}
+
+	// Count surveys of each hospital, and each (question, option) pair of selection answers.
+	// Surveys without trust weigh 1, same as getTrust.
+	trust := bson.D{{Key: "$ifNull", Value: bson.A{"$trust", 1}}}
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: filter}},
+		bson.D{{Key: "$facet", Value: bson.D{
+			{Key: "totals", Value: bson.A{
+				bson.D{{Key: "$group", Value: bson.D{
+					{Key: "_id", Value: "$hospitalId"},
+					{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+					{Key: "weight", Value: bson.D{{Key: "$sum", Value: trust}}},
+				}}},
+			}},
+			{Key: "counts", Value: bson.A{
+				bson.D{{Key: "$project", Value: bson.D{
+					{Key: "hospitalId", Value: 1},
+					{Key: "trust", Value: trust},
+					{Key: "answers", Value: bson.D{{Key: "$objectToArray", Value: "$answers"}}},
+				}}},
+				bson.D{{Key: "$unwind", Value: "$answers"}},
+				bson.D{{Key: "$match", Value: bson.D{{Key: "answers.v.type", Value: "selection"}}}},
+				bson.D{{Key: "$group", Value: bson.D{
+					{Key: "_id", Value: bson.D{
+						{Key: "hospitalId", Value: "$hospitalId"},
+						{Key: "question", Value: "$answers.k"},
+						{Key: "option", Value: "$answers.v.option"},
+					}},
+					{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+					{Key: "weight", Value: bson.D{{Key: "$sum", Value: "$trust"}}},
+				}}},
+			}},
+		}}},
+	}
+	cursor, err := surveyCollection.Aggregate(context.Background(), pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	var results []struct {
+		Totals []struct {
+			HospitalId string  `bson:"_id"`
+			Count      int     `bson:"count"`
+			Weight     float64 `bson:"weight"`
+		} `bson:"totals"`
+		Counts []struct {
+			Id struct {
+				HospitalId string `bson:"hospitalId"`
+				Question   string `bson:"question"`
+				Option     string `bson:"option"`
+			} `bson:"_id"`
+			Count  int     `bson:"count"`
+			Weight float64 `bson:"weight"`
+		} `bson:"counts"`
+	}
+	if err = cursor.All(context.Background(), &results); err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return documents, nil
+	}
+
+	for _, total := range results[0].Totals {
+		document := documents[total.HospitalId]
+		document.TotalCount = total.Count
+		document.TotalWeight = total.Weight
+		documents[total.HospitalId] = document
+	}
+	for _, count := range results[0].Counts {
+		document := documents[count.Id.HospitalId]
+		if document.Counts[count.Id.Question] == nil {
+			document.Counts[count.Id.Question] = map[string]int{}
+			document.Weights[count.Id.Question] = map[string]float64{}
+		}
+		document.Counts[count.Id.Question][count.Id.Option] = count.Count
+		document.Weights[count.Id.Question][count.Id.Option] = count.Weight
+	}
+	return documents, nil
+}
+
+// Get the maintained summaries of the hospitals in a single query
+func getSurveySummaryDocuments(collection *mongo.Collection,
+	hospitalIds []string) (map[string]SurveySummaryDocument, error) {
+	if collection.Name() != SurveySummaryCollectionName {
+		return nil, fmt.Errorf("got wrong collection: %s", collection.Name())
+	}
+
+	documents := map[string]SurveySummaryDocument{}
+	for _, hospitalId := range hospitalIds {
+		documents[hospitalId] = newSurveySummaryDocument(hospitalId)
+	}
+
+	cursor, err := collection.Find(context.Background(), bson.M{"_id": bson.M{"$in": hospitalIds}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(context.Background()) {
+		var document SurveySummaryDocument
+		err = cursor.Decode(&document)
+		if err != nil {
+			log.Println("Survey summary cursor decode error: " + err.Error())
+			continue
+		}
+		if document.Counts == nil {
+			document.Counts = map[string]map[string]int{}
+		}
+		documents[document.HospitalId] = document
+	}
+	return documents, nil
+}
+
+// Count options of the question by month (YYYY-MM) of submission
+func aggregateSurveyTrend(surveyCollection *mongo.Collection,
+	hospitalId string, question string, since time.Time) (map[string]map[string]int, error) {
+	if surveyCollection.Name() != SurveyCollectionName {
+		return nil, fmt.Errorf("got wrong collection: %s", surveyCollection.Name())
+	}
+
+	optionKey := "answers." + question + ".option"
+	filter := bson.M{
+		"hospitalId": hospitalId,
+		"timestamp":  bson.M{"$gte": since},
+		optionKey:    bson.M{"$nin": bson.A{"", nil}},
+		"hidden":     bson.M{"$ne": true},
+	}
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: filter}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{
+				{Key: "month", Value: bson.D{{Key: "$dateToString", Value: bson.D{
+					{Key: "format", Value: "%Y-%m"},
+					{Key: "date", Value: "$timestamp"},
+					{Key: "timezone", Value: time.Local.String()},
+				}}}},
+				{Key: "option", Value: "$" + optionKey},
+			}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+	}
+	cursor, err := surveyCollection.Aggregate(context.Background(), pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	months := map[string]map[string]int{}
+	for cursor.Next(context.Background()) {
+		var result struct {
+			Id struct {
+				Month  string `bson:"month"`
+				Option string `bson:"option"`
+			} `bson:"_id"`
+			Count int `bson:"count"`
+		}
+		err = cursor.Decode(&result)
+		if err != nil {
+			log.Println("Survey trend cursor decode error: " + err.Error())
+			continue
+		}
+		if months[result.Id.Month] == nil {
+			months[result.Id.Month] = map[string]int{}
+		}
+		months[result.Id.Month][result.Id.Option] = result.Count
+	}
+	return months, nil
+}
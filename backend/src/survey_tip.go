@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Text answers of surveys, kept separately to be moderated before being shown
+type SurveyTipDocument struct {
+	Id                 primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	HospitalId         string             `bson:"hospitalId" json:"hospitalId"`
+	UserId             string             `bson:"userId" json:"userId"`
+	Question           string             `bson:"question" json:"question"`
+	Text               string             `bson:"text" json:"text"`
+	State              string             `bson:"state" json:"state"` // "pending", "approved", "rejected"
+	Timestamp          string             `bson:"timestamp" json:"timestamp"`
+	ModeratedTimestamp string             `bson:"moderatedTimestamp" json:"moderatedTimestamp"`
+	Hidden             bool               `bson:"hidden,omitempty" json:"hidden"` // Survey is hidden by reports
+	HelpfulCount       int                `bson:"helpfulCount" json:"helpfulCount"`
+}
+
+type SurveyTip struct {
+	Id           string `json:"id"`
+	Question     string `json:"question"`
+	Text         string `json:"text"`
+	Timestamp    string `json:"timestamp"`
+	HelpfulCount int    `json:"helpfulCount"`
+}
+
+type SurveyTipListResponse struct {
+	Tips          []SurveyTip `json:"tips"`
+	TotalCount    int32       `json:"totalCount"`
+	PageableCount int32       `json:"pageableCount"`
+}
+
+// Tip in the moderation queue, without the author
+type SurveyTipModerationItem struct {
+	Id                 string `json:"id"`
+	HospitalId         string `json:"hospitalId"`
+	Question           string `json:"question"`
+	Text               string `json:"text"`
+	State              string `json:"state"`
+	Timestamp          string `json:"timestamp"`
+	ModeratedTimestamp string `json:"moderatedTimestamp"`
+	Hidden             bool   `json:"hidden"`
+}
+
+type SurveyTipModerationListResponse struct {
+	Tips          []SurveyTipModerationItem `json:"tips"`
+	TotalCount    int32                     `json:"totalCount"`
+	PageableCount int32                     `json:"pageableCount"`
+}
+
+type SurveyTipModerationRequest struct {
+	TipId string `json:"tipId"`
+	State string `json:"state"` // "approved", "rejected"
+}
+
+func ensureSurveyTipCollectionIndex(collection *mongo.Collection) bool {
+	if collection.Name() != SurveyTipCollectionName {
+		log.Printf("Got wrong collection: %s", collection.Name())
+		return false
+	}
+
+	indexModels := []mongo.IndexModel{
+		// One tip per question of a user survey
+		{
+			Keys: bson.D{
+				{Key: "hospitalId", Value: 1}, // 1 for ascending order
+				{Key: "userId", Value: 1},
+				{Key: "question", Value: 1},
+			},
+			Options: options.Index().SetUnique(true),
+		},
+		// Listing the latest tips of a hospital
+		{
+			Keys: bson.D{
+				{Key: "hospitalId", Value: 1},
+				{Key: "state", Value: 1},
+				{Key: "timestamp", Value: -1}, // -1 for descending order
+			},
+		},
+		// Listing the most helpful tips of a hospital
+		{
+			Keys: bson.D{
+				{Key: "hospitalId", Value: 1},
+				{Key: "state", Value: 1},
+				{Key: "helpfulCount", Value: -1},
+				{Key: "timestamp", Value: -1},
+			},
+		},
+	}
+
+	_, err := collection.Indexes().CreateMany(context.Background(), indexModels)
+	if err != nil {
+		log.Println("Could not create index in survey tip collection: " + err.Error())
+		return false
+	}
+	log.Println("Survey tip collection index created successfully")
+	return true
+}
+
+// Moderate text answers of the survey and save them as tips.
+// Returns the survey with moderated texts to be saved in the survey collection.
+// Answers of the given survey are not modified, so that it can be retried in a transaction.
+func recordSurveyTips(ctx context.Context, collection *mongo.Collection,
+	document SurveyAnswerDocument,
+	questionnaire SurveyQuestionnaireDocument,
+	timestamp string) (SurveyAnswerDocument, error) {
+	if collection.Name() != SurveyTipCollectionName {
+		return document, fmt.Errorf("got wrong collection: %s", collection.Name())
+	}
+
+	document.Answers = maps.Clone(document.Answers)
+	for key, question := range questionnaire.activeQuestions() {
+		if question.Type != "text" {
+			continue
+		}
+
+		filter := bson.M{"hospitalId": document.HospitalId, "userId": document.UserId, "question": key}
+		answer, ok := document.Answers[key]
+		if !ok || answer.Text == "" {
+			// Remove the tip of the previous submission
+			_, err := collection.DeleteOne(ctx, filter)
+			if err != nil {
+				return document, fmt.Errorf("failed to delete survey tip of %s for %s: %w",
+					document.HospitalId, document.UserId, err)
+			}
+			continue
+		}
+
+		result := moderateText(answer.Text)
+		answer.Text = result.Text
+		document.Answers[key] = answer
+
+		// Resubmitted texts are moderated again
+		update := bson.M{"$set": bson.M{
+			"text":               result.Text,
+			"state":              result.State,
+			"timestamp":          timestamp,
+			"moderatedTimestamp": "",
+		}}
+		_, err := collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+		if err != nil {
+			return document, fmt.Errorf("failed to save survey tip of %s for %s: %w",
+				document.HospitalId, document.UserId, err)
+		}
+	}
+
+	return document, nil
+}
+
+// Hide or show tips of the survey along with the survey
+func setSurveyTipsHidden(ctx context.Context, collection *mongo.Collection, hospitalId string, userId string, hidden bool) bool {
+	if collection.Name() != SurveyTipCollectionName {
+		log.Printf("Got wrong collection: %s", collection.Name())
+		return false
+	}
+
+	update := bson.M{"$set": bson.M{"hidden": true}}
+	if !hidden {
+		update = bson.M{"$unset": bson.M{"hidden": ""}}
+	}
+	_, err := collection.UpdateMany(ctx,
+		bson.M{"hospitalId": hospitalId, "userId": userId}, update)
+	if err != nil {
+		log.Println("Failed to update survey tips of " + hospitalId +
+			" for " + userId + ": " + err.Error())
+		return false
+	}
+	return true
+}
+
+// Remove tips of the user, of the hospital if hospitalId is given
+func deleteUserSurveyTips(ctx context.Context, collection *mongo.Collection, userId string, hospitalId string) (int64, error) {
+	if collection.Name() != SurveyTipCollectionName {
+		return 0, fmt.Errorf("got wrong collection: %s", collection.Name())
+	}
+
+	filter := bson.M{"userId": userId}
+	if hospitalId != "" {
+		filter["hospitalId"] = hospitalId
+	}
+	result, err := collection.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// Moderate text answers of existing surveys, which were saved before tips were introduced
+func backfillSurveyTips(tipCollection *mongo.Collection,
+	surveyCollection *mongo.Collection,
+	questionnaire SurveyQuestionnaireDocument) bool {
+	if tipCollection.Name() != SurveyTipCollectionName ||
+		surveyCollection.Name() != SurveyCollectionName {
+		log.Println("Wrong collection is assigned")
+		return false
+	}
+
+	// Skip if tips already exist
+	tipCount, err := tipCollection.CountDocuments(context.Background(), bson.M{})
+	if err != nil {
+		log.Println("Error in counting in backfillSurveyTips: " + err.Error())
+		return false
+	} else if tipCount > 0 {
+		return true
+	}
+
+	textFilters := bson.A{}
+	for key, question := range questionnaire.activeQuestions() {
+		if question.Type == "text" {
+			textFilters = append(textFilters, bson.M{"answers." + key + ".text": bson.M{"$nin": bson.A{"", nil}}})
+		}
+	}
+	if len(textFilters) == 0 {
+		return true
+	}
+
+	cursor, err := surveyCollection.Find(context.Background(), bson.M{"$or": textFilters})
+	if err != nil {
+		log.Println("Error in backfillSurveyTips: collection.Find: " + err.Error())
+		return false
+	}
+	defer cursor.Close(context.Background())
+
+	count := 0
+	for cursor.Next(context.Background()) {
+		var document SurveyAnswerDocument
+		err = cursor.Decode(&document)
+		if err != nil {
+			log.Println("Survey cursor decode error: " + err.Error())
+			continue
+		}
+		timestamp := document.Timestamp.String()
+		if timestamp == "" {
+			timestamp = time.Now().Format(TimestampFormat)
+		}
+		_, err = recordSurveyTips(context.Background(), tipCollection, document, questionnaire, timestamp)
+		if err != nil {
+			log.Println("Failed to backfill survey tips: " + err.Error())
+			continue
+		}
+		count++
+	}
+	log.Printf("Backfilled survey tips from %d surveys", count)
+	return true
+}
+
+func getPageParam(r *http.Request) (int64, error) {
+	pageParam := r.URL.Query().Get("page")
+	if pageParam == "" {
+		return 1, nil
+	}
+	page, err := strconv.ParseInt(pageParam, 10, 64)
+	if err != nil || page < 1 {
+		return 0, fmt.Errorf("bad page param: %s", pageParam)
+	}
+	return page, nil
+}
+
+// Get the most helpful approved tips of the hospital in the page (starts from 1).
+// Tips with the same votes are sorted by recency.
+func getApprovedSurveyTips(collection *mongo.Collection,
+	hospitalId string, question string, page int64) ([]SurveyTip, int64, error) {
+	if collection.Name() != SurveyTipCollectionName {
+		return nil, 0, fmt.Errorf("got wrong collection: %s", collection.Name())
+	}
+
+	filter := bson.M{"hospitalId": hospitalId, "state": "approved", "hidden": bson.M{"$ne": true}}
+	if question != "" {
+		filter["question"] = question
+	}
+
+	totalCount, err := collection.CountDocuments(context.Background(), filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	tips := []SurveyTip{}
+	if totalCount == 0 {
+		return tips, 0, nil
+	}
+
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{
+		{Key: "helpfulCount", Value: -1}, // -1 for descending order
+		{Key: "timestamp", Value: -1},
+		{Key: "_id", Value: -1},
+	})
+	findOptions.SetSkip((page - 1) * SurveyTipPageableCount)
+	findOptions.SetLimit(SurveyTipPageableCount)
+
+	cursor, err := collection.Find(context.Background(), filter, findOptions)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(context.Background()) {
+		var document SurveyTipDocument
+		err = cursor.Decode(&document)
+		if err != nil {
+			log.Println("Survey tip cursor decode error: " + err.Error())
+			continue
+		}
+		tips = append(tips, SurveyTip{
+			Id:           document.Id.Hex(),
+			Question:     document.Question,
+			Text:         document.Text,
+			Timestamp:    document.Timestamp,
+			HelpfulCount: document.HelpfulCount,
+		})
+	}
+
+	return tips, totalCount, nil
+}
+
+func handleGetSurveyTips(collection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if collection.Name() != SurveyTipCollectionName {
+			log.Printf("Got wrong collection: %s", collection.Name())
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+
+		hospitalId := r.URL.Query().Get("hospitalId")
+		if hospitalId == "" {
+			http.Error(w, "hospitalId is empty", http.StatusBadRequest)
+			return
+		}
+		page, err := getPageParam(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tips, totalCount, err := getApprovedSurveyTips(collection,
+			hospitalId, r.URL.Query().Get("question"), page)
+		if err != nil {
+			log.Println("Error while finding survey tips: " + err.Error())
+			http.Error(w, "Error while finding survey tips", http.StatusInternalServerError)
+			return
+		}
+
+		response := SurveyTipListResponse{
+			Tips:          tips,
+			TotalCount:    int32(totalCount),
+			PageableCount: int32(len(tips)),
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func handleGetSurveyTipsForModeration(collection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if collection.Name() != SurveyTipCollectionName {
+			log.Printf("Got wrong collection: %s", collection.Name())
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+
+		state := r.URL.Query().Get("state")
+		if state == "" {
+			state = "pending"
+		}
+		page, err := getPageParam(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		filter := bson.M{"state": state}
+		totalCount, err := collection.CountDocuments(context.Background(), filter)
+		if err != nil {
+			log.Println("Error in handleGetSurveyTipsForModeration: CountDocuments: " + err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		documents := []SurveyTipDocument{}
+		if totalCount > 0 {
+			// Oldest first to review in submitted order
+			findOptions := options.Find()
+			findOptions.SetSort(bson.D{{Key: "timestamp", Value: 1}})
+			findOptions.SetSkip((page - 1) * SurveyTipPageableCount)
+			findOptions.SetLimit(SurveyTipPageableCount)
+
+			cursor, err := collection.Find(context.Background(), filter, findOptions)
+			if err != nil {
+				log.Println("Error in handleGetSurveyTipsForModeration: collection.Find: " + err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer cursor.Close(context.Background())
+
+			if err = cursor.All(context.Background(), &documents); err != nil {
+				log.Println("Error in handleGetSurveyTipsForModeration: cursor.All: " + err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		tips := []SurveyTipModerationItem{}
+		for _, document := range documents {
+			tips = append(tips, SurveyTipModerationItem{
+				Id:                 document.Id.Hex(),
+				HospitalId:         document.HospitalId,
+				Question:           document.Question,
+				Text:               document.Text,
+				State:              document.State,
+				Timestamp:          document.Timestamp,
+				ModeratedTimestamp: document.ModeratedTimestamp,
+				Hidden:             document.Hidden,
+			})
+		}
+
+		response := SurveyTipModerationListResponse{
+			Tips:          tips,
+			TotalCount:    int32(totalCount),
+			PageableCount: int32(len(tips)),
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func handlePostSurveyTipModeration(collection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if collection.Name() != SurveyTipCollectionName {
+			log.Printf("Got wrong collection: %s", collection.Name())
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+
+		var request SurveyTipModerationRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Println("Failed to decode survey tip moderation request: " + err.Error())
+			return
+		}
+
+		fieldErrors := []FieldError{}
+		tipId, err := primitive.ObjectIDFromHex(request.TipId)
+		if err != nil {
+			fieldErrors = append(fieldErrors, FieldError{Field: "tipId", Message: "tipId is not valid"})
+		}
+		if request.State != "approved" && request.State != "rejected" {
+			fieldErrors = append(fieldErrors, FieldError{Field: "state",
+				Message: "state should be approved or rejected"})
+		}
+		if len(fieldErrors) > 0 {
+			writeFieldErrors(w, fieldErrors)
+			return
+		}
+
+		update := bson.M{"$set": bson.M{
+			"state":              request.State,
+			"moderatedTimestamp": time.Now().Format(TimestampFormat),
+		}}
+		result, err := collection.UpdateOne(context.Background(), bson.M{"_id": tipId}, update)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Println("Failed to moderate survey tip " + request.TipId + ": " + err.Error())
+			return
+		}
+		if result.MatchedCount == 0 {
+			http.Error(w, "Survey tip not found", http.StatusNotFound)
+			return
+		}
+
+		log.Printf("Survey tip %s is %s", request.TipId, request.State)
+		fmt.Fprintf(w, "Survey tip moderated")
+	}
+}
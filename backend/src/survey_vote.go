@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// "Helpful" votes on a survey answer, shared by all tips of the answer
+type SurveyVoteDocument struct {
+	HospitalId string   `bson:"hospitalId"`
+	UserId     string   `bson:"userId"`   // Author of the survey
+	VoterIds   []string `bson:"voterIds"` // User IDs who found the tips helpful
+	Count      int      `bson:"count"`
+}
+
+type SurveyVotePostRequest struct {
+	TipId   string `json:"tipId"` // Any tip of the survey answer
+	VoterId string `json:"voterId"`
+	Helpful int    `json:"helpful"` // 1: helpful 0: undo
+}
+
+type SurveyVoteResponse struct {
+	Found        int `json:"found"`
+	HelpfulCount int `json:"helpfulCount"`
+}
+
+func ensureSurveyVoteCollectionIndex(collection *mongo.Collection) bool {
+	if collection.Name() != SurveyVoteCollectionName {
+		log.Printf("Got wrong collection: %s", collection.Name())
+		return false
+	}
+
+	indexModels := []mongo.IndexModel{
+		// One document per survey answer
+		{
+			Keys: bson.D{
+				{Key: "hospitalId", Value: 1}, // 1 for ascending order
+				{Key: "userId", Value: 1},
+			},
+			Options: options.Index().SetUnique(true),
+		},
+		// Finding votes of a voter
+		{
+			Keys: bson.D{
+				{Key: "voterIds", Value: 1},
+			},
+		},
+	}
+
+	_, err := collection.Indexes().CreateMany(context.Background(), indexModels)
+	if err != nil {
+		log.Println("Could not create index in survey vote collection: " + err.Error())
+		return false
+	}
+	log.Println("Survey vote collection index created successfully")
+	return true
+}
+
+// Add or remove the voter, and keep the count in sync with the voters in a single update
+func recordSurveyVote(collection *mongo.Collection,
+	hospitalId string, userId string, voterId string, helpful bool) (SurveyVoteDocument, error) {
+	if collection.Name() != SurveyVoteCollectionName {
+		return SurveyVoteDocument{}, fmt.Errorf("got wrong collection: %s", collection.Name())
+	}
+
+	voterIds := bson.D{{Key: "$ifNull", Value: bson.A{"$voterIds", bson.A{}}}}
+	operator := "$setUnion"
+	if !helpful {
+		operator = "$setDifference"
+	}
+	update := mongo.Pipeline{
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "voterIds", Value: bson.D{{Key: operator, Value: bson.A{voterIds, bson.A{voterId}}}}},
+		}}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "count", Value: bson.D{{Key: "$size", Value: "$voterIds"}}},
+		}}},
+	}
+	opts := options.FindOneAndUpdate().
+		SetUpsert(true).
+		SetReturnDocument(options.After)
+
+	var document SurveyVoteDocument
+	err := collection.FindOneAndUpdate(context.Background(),
+		bson.M{"hospitalId": hospitalId, "userId": userId}, update, opts).Decode(&document)
+	return document, err
+}
+
+// Copy the vote count to tips of the survey answer, so that tips can be sorted by it
+func setSurveyTipsHelpfulCount(collection *mongo.Collection, hospitalId string, userId string, count int) bool {
+	if collection.Name() != SurveyTipCollectionName {
+		log.Printf("Got wrong collection: %s", collection.Name())
+		return false
+	}
+
+	_, err := collection.UpdateMany(context.Background(),
+		bson.M{"hospitalId": hospitalId, "userId": userId},
+		bson.M{"$set": bson.M{"helpfulCount": count}})
+	if err != nil {
+		log.Println("Failed to update helpful count of survey tips of " + hospitalId +
+			" for " + userId + ": " + err.Error())
+		return false
+	}
+	return true
+}
+
+// Remove all votes of the voter, and returns the number of unvoted surveys
+func removeAllSurveyVotes(voteCollection *mongo.Collection,
+	tipCollection *mongo.Collection, voterId string) (int64, error) {
+	if voteCollection.Name() != SurveyVoteCollectionName {
+		return 0, fmt.Errorf("got wrong collection: %s", voteCollection.Name())
+	}
+
+	cursor, err := voteCollection.Find(context.Background(), bson.M{"voterIds": voterId})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(context.Background())
+
+	var documents []SurveyVoteDocument
+	if err = cursor.All(context.Background(), &documents); err != nil {
+		return 0, err
+	}
+
+	for _, document := range documents {
+		updated, err := recordSurveyVote(voteCollection, document.HospitalId, document.UserId, voterId, false)
+		if err != nil {
+			return 0, err
+		}
+		setSurveyTipsHelpfulCount(tipCollection, updated.HospitalId, updated.UserId, updated.Count)
+	}
+	return int64(len(documents)), nil
+}
+
+func handlePostSurveyVote(voteCollection *mongo.Collection,
+	tipCollection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if voteCollection.Name() != SurveyVoteCollectionName ||
+			tipCollection.Name() != SurveyTipCollectionName {
+			log.Println("Wrong collection is assigned")
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+
+		var voteReq SurveyVotePostRequest
+		err := json.NewDecoder(r.Body).Decode(&voteReq)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Println("Failed to decode survey vote post request: " + err.Error())
+			return
+		}
+
+		fieldErrors := []FieldError{}
+		tipId, err := primitive.ObjectIDFromHex(voteReq.TipId)
+		if err != nil {
+			fieldErrors = append(fieldErrors, FieldError{Field: "tipId", Message: "tipId is not valid"})
+		}
+		if voteReq.VoterId == "" {
+			fieldErrors = append(fieldErrors, FieldError{Field: "voterId", Message: "voterId is empty"})
+		}
+		if len(fieldErrors) > 0 {
+			writeFieldErrors(w, fieldErrors)
+			return
+		}
+
+		// Find the survey answer of the tip
+		var tip SurveyTipDocument
+		err = tipCollection.FindOne(context.Background(), bson.M{"_id": tipId}).Decode(&tip)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Survey tip not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Println("Failed to find survey tip " + voteReq.TipId + ": " + err.Error())
+			return
+		}
+		if tip.UserId == voteReq.VoterId {
+			writeFieldErrors(w, []FieldError{{Field: "voterId",
+				Message: "users can not vote for their own survey"}})
+			return
+		}
+
+		helpful := voteReq.Helpful != 0
+		document, err := recordSurveyVote(voteCollection, tip.HospitalId, tip.UserId, voteReq.VoterId, helpful)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Println("Failed to add vote " + strconv.Itoa(voteReq.Helpful) +
+				" to " + voteReq.TipId + " for " + voteReq.VoterId + ": " +
+				err.Error())
+			return
+		}
+		setSurveyTipsHelpfulCount(tipCollection, tip.HospitalId, tip.UserId, document.Count)
+
+		response := SurveyVoteResponse{
+			Found:        0,
+			HelpfulCount: document.Count,
+		}
+		if helpful {
+			response.Found = 1
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func handleGetSurveyVoteFound(voteCollection *mongo.Collection,
+	tipCollection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if voteCollection.Name() != SurveyVoteCollectionName ||
+			tipCollection.Name() != SurveyTipCollectionName {
+			log.Println("Wrong collection is assigned")
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+
+		tipId, err := primitive.ObjectIDFromHex(r.URL.Query().Get("tipId"))
+		if err != nil {
+			http.Error(w, "tipId is not valid", http.StatusBadRequest)
+			return
+		}
+		voterId := r.URL.Query().Get("voterId")
+		if voterId == "" {
+			http.Error(w, "voterId is empty", http.StatusBadRequest)
+			return
+		}
+
+		var tip SurveyTipDocument
+		err = tipCollection.FindOne(context.Background(), bson.M{"_id": tipId}).Decode(&tip)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Survey tip not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Println("Error while finding survey tip: " + err.Error())
+			http.Error(w, "Error while finding survey tip", http.StatusInternalServerError)
+			return
+		}
+
+		var document SurveyVoteDocument
+		err = voteCollection.FindOne(context.Background(),
+			bson.M{"hospitalId": tip.HospitalId, "userId": tip.UserId}).Decode(&document)
+
+		// There is a chance that the document doesn't exist
+		if err != nil && err != mongo.ErrNoDocuments {
+			log.Println("Error while finding survey vote: " + err.Error())
+			http.Error(w, "Error while finding survey vote", http.StatusInternalServerError)
+			return
+		}
+
+		// Check if voterId is in the voters array
+		response := SurveyVoteResponse{
+			Found:        0,
+			HelpfulCount: document.Count,
+		}
+		for _, id := range document.VoterIds {
+			if id == voterId {
+				response.Found = 1
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
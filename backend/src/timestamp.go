@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// Time stored as a BSON date, and exchanged as TimestampFormat string in JSON.
+// Legacy documents with string timestamps are decoded as well.
+type Timestamp struct {
+	time.Time
+}
+
+func newTimestamp() Timestamp {
+	return Timestamp{Time: time.Now()}
+}
+
+func (t Timestamp) String() string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Local().Format(TimestampFormat)
+}
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+// Unparsable timestamps are ignored instead of failing the whole request,
+// as timestamps from clients are not trusted anyway
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil
+	}
+	t.Time = parseTimestamp(value)
+	return nil
+}
+
+func (t Timestamp) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	return bson.MarshalValue(t.Time)
+}
+
+func (t *Timestamp) UnmarshalBSONValue(valueType bsontype.Type, data []byte) error {
+	raw := bson.RawValue{Type: valueType, Value: data}
+	switch valueType {
+	case bsontype.DateTime:
+		t.Time = raw.Time().Local()
+	case bsontype.String:
+		t.Time = parseTimestamp(raw.StringValue())
+	case bsontype.Null, bsontype.Undefined:
+		t.Time = time.Time{}
+	default:
+		return fmt.Errorf("can not decode %s to timestamp", valueType)
+	}
+	return nil
+}
+
+func parseTimestamp(value string) time.Time {
+	for _, layout := range []string{TimestampFormat, time.RFC3339, "2006-01-02"} {
+		parsed, err := time.ParseInLocation(layout, value, time.Local)
+		if err == nil {
+			return parsed
+		}
+	}
+	return time.Time{}
+}
+
+// Get the beginning of the time window from since param (e.g. 2024-01-01)
+// or window param (e.g. 30d, 2w, 6m, 1y). Returns zero time if both are empty.
+func getSinceParam(r *http.Request) (time.Time, error) {
+	since := r.URL.Query().Get("since")
+	if since != "" {
+		parsed := parseTimestamp(since)
+		if parsed.IsZero() {
+			return time.Time{}, fmt.Errorf("bad since param: %s", since)
+		}
+		return parsed, nil
+	}
+
+	window := r.URL.Query().Get("window")
+	if window == "" {
+		return time.Time{}, nil
+	}
+	if len(window) < 2 {
+		return time.Time{}, fmt.Errorf("bad window param: %s", window)
+	}
+	amount, err := strconv.Atoi(window[:len(window)-1])
+	if err != nil || amount <= 0 {
+		return time.Time{}, fmt.Errorf("bad window param: %s", window)
+	}
+
+	now := time.Now()
+	switch window[len(window)-1] {
+	case 'd':
+		return now.AddDate(0, 0, -amount), nil
+	case 'w':
+		return now.AddDate(0, 0, -7*amount), nil
+	case 'm':
+		return now.AddDate(0, -amount, 0), nil
+	case 'y':
+		return now.AddDate(-amount, 0, 0), nil
+	default:
+		return time.Time{}, fmt.Errorf("bad window param: %s", window)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Transactions are available only on replica sets and sharded clusters.
+// Set by detectTransactionSupport on start.
+var _transactionSupported = false
+
+func detectTransactionSupport(client *mongo.Client) bool {
+	var result struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	err := client.Database("admin").RunCommand(context.Background(),
+		bson.D{{Key: "hello", Value: 1}}).Decode(&result)
+	if err != nil {
+		log.Println("Failed to check transaction support: " + err.Error())
+		return false
+	}
+
+	_transactionSupported = result.SetName != "" || result.Msg == "isdbgrid"
+	if _transactionSupported {
+		log.Println("Paired writes run in transactions")
+	} else {
+		log.Println("Transactions are not supported by the standalone server, " +
+			"paired writes run in sequence and can be repaired by " + CommandReconcile)
+	}
+	return _transactionSupported
+}
+
+// Run writes in a transaction, or in sequence if transactions are not supported.
+// The function can be retried on transient errors, so it should not keep state between runs.
+func runInTransaction(client *mongo.Client, fn func(ctx context.Context) error) error {
+	if !_transactionSupported {
+		return fn(context.Background())
+	}
+
+	session, err := client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.Background())
+
+	_, err = session.WithTransaction(context.Background(), func(sessionContext mongo.SessionContext) (any, error) {
+		return nil, fn(sessionContext)
+	})
+	return err
+}
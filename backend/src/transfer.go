@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Unambiguous characters for typing the code on another phone
+const transferCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// One-time code to move the data of a user to another device, expired by the TTL index
+type TransferCodeDocument struct {
+	Code      string    `bson:"_id"`
+	UserId    string    `bson:"userId"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+type TransferCodeRequest struct {
+	UserId string `json:"userId"`
+}
+
+type TransferCodeResponse struct {
+	Code      string `json:"code"`
+	ExpiresAt string `json:"expiresAt"`
+}
+
+type TransferRequest struct {
+	Code   string `json:"code"`
+	UserId string `json:"userId"` // New user to receive the data
+}
+
+type TransferResponse struct {
+	FromUserId      string `json:"fromUserId"`
+	MovedLikes      int    `json:"movedLikes"`
+	MovedSurveys    int    `json:"movedSurveys"`
+	ReplacedSurveys int    `json:"replacedSurveys"` // Conflicting surveys of the new user replaced by newer ones
+	MovedLists      int64  `json:"movedLists"`
+	MovedVotes      int    `json:"movedVotes"` // Helpful votes cast by the old user
+	MovedWaiting    int64  `json:"movedWaiting"`
+	MovedActivities int64  `json:"movedActivities"`
+	MovedReports    int    `json:"movedReports"` // Survey reports filed by the old user
+}
+
+func ensureTransferCodeCollectionIndex(collection *mongo.Collection) bool {
+	if collection.Name() != TransferCodeCollectionName {
+		log.Printf("Got wrong collection: %s", collection.Name())
+		return false
+	}
+
+	indexModels := []mongo.IndexModel{
+		// Replacing codes of a user
+		{
+			Keys: bson.D{
+				{Key: "userId", Value: 1}, // 1 for ascending order
+			},
+		},
+		// Expire old codes
+		{
+			Keys: bson.D{
+				{Key: "createdAt", Value: 1},
+			},
+			Options: options.Index().SetExpireAfterSeconds(int32(TransferCodeTtl.Seconds())),
+		},
+	}
+
+	_, err := collection.Indexes().CreateMany(context.Background(), indexModels)
+	if err != nil {
+		log.Println("Could not create index in transfer code collection: " + err.Error())
+		return false
+	}
+	log.Println("Transfer code collection index created successfully")
+	return true
+}
+
+func newTransferCode() (string, error) {
+	bytes := make([]byte, TransferCodeLength)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	code := make([]byte, TransferCodeLength)
+	for i, b := range bytes {
+		code[i] = transferCodeAlphabet[int(b)%len(transferCodeAlphabet)]
+	}
+	return string(code), nil
+}
+
+// Move likes of the old user to the new user. Likes of both users are merged into one.
+func transferLikes(ctx context.Context, likeCollection *mongo.Collection,
+	likeCountCollection *mongo.Collection, fromUserId string, toUserId string) (int, error) {
+	existing, err := likeCollection.Distinct(ctx, "hospitalId", bson.M{"userId": toUserId})
+	if err != nil {
+		return 0, err
+	}
+	liked := map[string]bool{}
+	for _, value := range existing {
+		if hospitalId, ok := value.(string); ok {
+			liked[hospitalId] = true
+		}
+	}
+
+	cursor, err := likeCollection.Find(ctx, bson.M{"userId": fromUserId})
+	if err != nil {
+		return 0, err
+	}
+	var likes []LikeDocument
+	if err = cursor.All(ctx, &likes); err != nil {
+		return 0, err
+	}
+
+	for _, like := range likes {
+		filter := bson.M{"hospitalId": like.HospitalId, "userId": fromUserId}
+		if liked[like.HospitalId] {
+			if _, err = likeCollection.DeleteOne(ctx, filter); err != nil {
+				return 0, err
+			}
+			if !updateLikeCount(ctx, likeCountCollection, like.HospitalId, -1) {
+				return 0, fmt.Errorf("failed to update like count of %s", like.HospitalId)
+			}
+			continue
+		}
+		_, err = likeCollection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"userId": toUserId}})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(likes), nil
+}
+
+// Move reports on the survey of a hospital of the old user to the new user, so that the moderation
+// and the trust of the new user reflect them. Reports of a reporter already on the new user are removed.
+func transferReportsOfSurvey(ctx context.Context, reportCollection *mongo.Collection,
+	hospitalId string, fromUserId string, toUserId string) error {
+	reporterIds, err := reportCollection.Distinct(ctx, "reporterId",
+		bson.M{"hospitalId": hospitalId, "userId": toUserId})
+	if err != nil {
+		return err
+	}
+	filter := bson.M{"hospitalId": hospitalId, "userId": fromUserId}
+	_, err = reportCollection.UpdateMany(ctx,
+		bson.M{"hospitalId": hospitalId, "userId": fromUserId, "reporterId": bson.M{"$nin": reporterIds}},
+		bson.M{"$set": bson.M{"userId": toUserId}})
+	if err != nil {
+		return err
+	}
+	_, err = reportCollection.DeleteMany(ctx, filter)
+	return err
+}
+
+// Move surveys of the old user to the new user with their tips, votes and reports.
+// If both users have a survey of a hospital, the latest one is kept.
+func transferSurveys(ctx context.Context, surveyCollection *mongo.Collection,
+	tipCollection *mongo.Collection, summaryCollection *mongo.Collection, voteCollection *mongo.Collection,
+	reportCollection *mongo.Collection, fromUserId string, toUserId string) (int, int, error) {
+	cursor, err := surveyCollection.Find(ctx, bson.M{"userId": toUserId})
+	if err != nil {
+		return 0, 0, err
+	}
+	var existing []SurveyAnswerDocument
+	if err = cursor.All(ctx, &existing); err != nil {
+		return 0, 0, err
+	}
+	surveys := map[string]SurveyAnswerDocument{}
+	for _, survey := range existing {
+		surveys[survey.HospitalId] = survey
+	}
+
+	cursor, err = surveyCollection.Find(ctx, bson.M{"userId": fromUserId})
+	if err != nil {
+		return 0, 0, err
+	}
+	var moving []SurveyAnswerDocument
+	if err = cursor.All(ctx, &moving); err != nil {
+		return 0, 0, err
+	}
+
+	moved, replaced := 0, 0
+	for _, survey := range moving {
+		// Reports are about the user, so they are kept even if the survey is replaced
+		if err = transferReportsOfSurvey(ctx, reportCollection, survey.HospitalId, fromUserId, toUserId); err != nil {
+			return 0, 0, err
+		}
+
+		// Remove the older one of the conflicting surveys
+		if current, ok := surveys[survey.HospitalId]; ok {
+			loserId := toUserId
+			if !survey.Timestamp.After(current.Timestamp.Time) {
+				loserId = fromUserId
+			}
+			if _, err = deleteSurveyAnswer(ctx, surveyCollection, tipCollection, summaryCollection,
+				survey.HospitalId, loserId); err != nil {
+				return 0, 0, err
+			}
+			_, err = voteCollection.DeleteOne(ctx, bson.M{"hospitalId": survey.HospitalId, "userId": loserId})
+			if err != nil {
+				return 0, 0, err
+			}
+			if loserId == fromUserId {
+				continue
+			}
+			replaced++
+		}
+
+		// Fields of survey documents are lowercased, except the ones of the upsert filter
+		filter := bson.M{"hospitalId": survey.HospitalId, "userId": fromUserId}
+		_, err = surveyCollection.UpdateOne(ctx, filter,
+			bson.M{"$set": bson.M{"userId": toUserId, "userid": toUserId}})
+		if err != nil {
+			return 0, 0, err
+		}
+		update := bson.M{"$set": bson.M{"userId": toUserId}}
+		if _, err = tipCollection.UpdateMany(ctx, filter, update); err != nil {
+			return 0, 0, err
+		}
+		if _, err = voteCollection.UpdateOne(ctx, filter, update); err != nil {
+			return 0, 0, err
+		}
+		moved++
+	}
+	return moved, replaced, nil
+}
+
+// Move survey reports filed by the old user to the new user.
+// Reports of a survey already reported by the new user are removed.
+func transferFiledReports(ctx context.Context, reportCollection *mongo.Collection,
+	fromUserId string, toUserId string) (int, error) {
+	cursor, err := reportCollection.Find(ctx, bson.M{"reporterId": fromUserId})
+	if err != nil {
+		return 0, err
+	}
+	var reports []SurveyReportDocument
+	if err = cursor.All(ctx, &reports); err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, report := range reports {
+		count, err := reportCollection.CountDocuments(ctx, bson.M{
+			"hospitalId": report.HospitalId, "userId": report.UserId, "reporterId": toUserId})
+		if err != nil {
+			return 0, err
+		}
+		if count > 0 {
+			_, err = reportCollection.DeleteOne(ctx, bson.M{"_id": report.Id})
+		} else {
+			_, err = reportCollection.UpdateOne(ctx, bson.M{"_id": report.Id},
+				bson.M{"$set": bson.M{"reporterId": toUserId}})
+			moved++
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return moved, nil
+}
+
+// Move helpful votes cast by the old user to the new user.
+// Votes on surveys of the new user are removed, as users can not vote for their own survey.
+func transferSurveyVotes(ctx context.Context, voteCollection *mongo.Collection,
+	tipCollection *mongo.Collection, fromUserId string, toUserId string) (int, error) {
+	cursor, err := voteCollection.Find(ctx, bson.M{"$or": bson.A{
+		bson.M{"voterIds": fromUserId},
+		bson.M{"userId": toUserId, "voterIds": toUserId}, // Moved with the surveys of the old user
+	}})
+	if err != nil {
+		return 0, err
+	}
+	var documents []SurveyVoteDocument
+	if err = cursor.All(ctx, &documents); err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, document := range documents {
+		voted := false
+		voterIds := []string{}
+		for _, voterId := range document.VoterIds {
+			if voterId == fromUserId {
+				voted = true
+			} else if voterId != toUserId || document.UserId != toUserId {
+				voterIds = append(voterIds, voterId)
+			}
+		}
+		if voted && document.UserId != toUserId && !slices.Contains(voterIds, toUserId) {
+			voterIds = append(voterIds, toUserId)
+			moved++
+		}
+
+		filter := bson.M{"hospitalId": document.HospitalId, "userId": document.UserId}
+		_, err = voteCollection.UpdateOne(ctx, filter,
+			bson.M{"$set": bson.M{"voterIds": voterIds, "count": len(voterIds)}})
+		if err != nil {
+			return 0, err
+		}
+		_, err = tipCollection.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"helpfulCount": len(voterIds)}})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return moved, nil
+}
+
+// Merge the user document of the old user into the new user, and remove the old one
+func transferUserDocument(ctx context.Context, userCollection *mongo.Collection,
+	fromUserId string, toUserId string) error {
+	var document UserDocument
+	err := userCollection.FindOneAndDelete(ctx, bson.M{"_id": fromUserId}).Decode(&document)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	update := bson.M{"$addToSet": bson.M{"surveys": bson.M{"$each": append([]string{}, document.Surveys...)}}}
+	_, err = userCollection.UpdateOne(ctx, bson.M{"_id": toUserId}, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// Issue a transfer code of the user on the old device. Previous codes are invalidated.
+func handlePostTransferCode(collection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if collection.Name() != TransferCodeCollectionName {
+			log.Printf("Got wrong collection: %s", collection.Name())
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+
+		var request TransferCodeRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Println("Failed to decode transfer code request: " + err.Error())
+			return
+		}
+		if request.UserId == "" {
+			http.Error(w, "userId is empty", http.StatusBadRequest)
+			return
+		}
+
+		_, err = collection.DeleteMany(context.Background(), bson.M{"userId": request.UserId})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Println("Failed to delete transfer codes of " + request.UserId + ": " + err.Error())
+			return
+		}
+
+		code, err := newTransferCode()
+		if err != nil {
+			http.Error(w, "Error while creating transfer code", http.StatusInternalServerError)
+			log.Println("Failed to create transfer code: " + err.Error())
+			return
+		}
+		document := TransferCodeDocument{Code: code, UserId: request.UserId, CreatedAt: time.Now()}
+		if _, err = collection.InsertOne(context.Background(), document); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Println("Failed to save transfer code of " + request.UserId + ": " + err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(TransferCodeResponse{
+			Code:      code,
+			ExpiresAt: document.CreatedAt.Add(TransferCodeTtl).Format(TimestampFormat),
+		})
+	}
+}
+
+// Redeem a transfer code on the new device, and move likes, surveys, lists, votes,
+// waiting reports and activity events of the old user
+func handlePostTransfer(codeCollection *mongo.Collection,
+	userCollection *mongo.Collection,
+	likeCollection *mongo.Collection,
+	likeCountCollection *mongo.Collection,
+	surveyCollection *mongo.Collection,
+	tipCollection *mongo.Collection,
+	summaryCollection *mongo.Collection,
+	voteCollection *mongo.Collection,
+	listCollection *mongo.Collection,
+	waitingCollection *mongo.Collection,
+	activityCollection *mongo.Collection,
+	reportCollection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if codeCollection.Name() != TransferCodeCollectionName ||
+			userCollection.Name() != UserCollectionName ||
+			likeCollection.Name() != LikeCollectionName ||
+			likeCountCollection.Name() != LikeCountCollectionName ||
+			surveyCollection.Name() != SurveyCollectionName ||
+			tipCollection.Name() != SurveyTipCollectionName ||
+			summaryCollection.Name() != SurveySummaryCollectionName ||
+			voteCollection.Name() != SurveyVoteCollectionName ||
+			listCollection.Name() != FavoriteListCollectionName ||
+			waitingCollection.Name() != WaitingReportCollectionName ||
+			activityCollection.Name() != ActivityEventCollectionName ||
+			reportCollection.Name() != SurveyReportCollectionName {
+			log.Println("Wrong collection is assigned")
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+
+		var request TransferRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Println("Failed to decode transfer request: " + err.Error())
+			return
+		}
+		code := strings.ToUpper(strings.ReplaceAll(request.Code, "-", ""))
+		if code == "" || request.UserId == "" {
+			http.Error(w, "code or userId is empty", http.StatusBadRequest)
+			return
+		}
+
+		// The code is consumed in the same transaction, so that a failed transfer can be retried.
+		// A code of the same user is kept, as it can still be redeemed on another device.
+		found := false
+		response := TransferResponse{}
+		err = runInTransaction(codeCollection.Database().Client(), func(ctx context.Context) error {
+			var document TransferCodeDocument
+			err := codeCollection.FindOne(ctx, bson.M{
+				"_id":       code,
+				"createdAt": bson.M{"$gte": time.Now().Add(-TransferCodeTtl)},
+			}).Decode(&document)
+			found = err == nil
+			if err == mongo.ErrNoDocuments || (found && document.UserId == request.UserId) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if _, err = codeCollection.DeleteOne(ctx, bson.M{"_id": code}); err != nil {
+				return err
+			}
+
+			response = TransferResponse{FromUserId: document.UserId}
+			response.MovedLikes, err = transferLikes(ctx, likeCollection, likeCountCollection,
+				document.UserId, request.UserId)
+			if err != nil {
+				return err
+			}
+			response.MovedSurveys, response.ReplacedSurveys, err = transferSurveys(ctx, surveyCollection,
+				tipCollection, summaryCollection, voteCollection, reportCollection, document.UserId, request.UserId)
+			if err != nil {
+				return err
+			}
+			result, err := listCollection.UpdateMany(ctx, bson.M{"userId": document.UserId},
+				bson.M{"$set": bson.M{"userId": request.UserId}})
+			if err != nil {
+				return err
+			}
+			response.MovedLists = result.ModifiedCount
+			response.MovedVotes, err = transferSurveyVotes(ctx, voteCollection, tipCollection,
+				document.UserId, request.UserId)
+			if err != nil {
+				return err
+			}
+			result, err = waitingCollection.UpdateMany(ctx, bson.M{"userId": document.UserId},
+				bson.M{"$set": bson.M{"userId": request.UserId}})
+			if err != nil {
+				return err
+			}
+			response.MovedWaiting = result.ModifiedCount
+			result, err = activityCollection.UpdateMany(ctx, bson.M{"userId": document.UserId},
+				bson.M{"$set": bson.M{"userId": request.UserId}})
+			if err != nil {
+				return err
+			}
+			response.MovedActivities = result.ModifiedCount
+			response.MovedReports, err = transferFiledReports(ctx, reportCollection, document.UserId, request.UserId)
+			if err != nil {
+				return err
+			}
+			return transferUserDocument(ctx, userCollection, document.UserId, request.UserId)
+		})
+		if err != nil {
+			http.Error(w, "Error while transferring user data", http.StatusInternalServerError)
+			log.Println("Failed to transfer user data to " + request.UserId + ": " + err.Error())
+			return
+		}
+		if !found {
+			http.Error(w, "Transfer code not found or expired", http.StatusNotFound)
+			return
+		}
+		if response.FromUserId == "" {
+			http.Error(w, "Transfer code is issued by the same user", http.StatusBadRequest)
+			return
+		}
+		log.Printf("Transferred user data from %s to %s: %+v", response.FromUserId, request.UserId, response)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
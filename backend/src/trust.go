@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Last refresh of trust scores in the settings collection
+type TrustRefreshDocument struct {
+	Id      string    `bson:"_id"`
+	LastRun time.Time `bson:"lastRun"`
+}
+
+// Compute the trust of a user from the account age, the activity rate,
+// the report history and the answer variance
+func computeTrust(firstSeen time.Time, surveys []SurveyAnswerDocument, upheldReports int, now time.Time) float64 {
+	trust := 1.0
+
+	// Account age, from the first device registration, like or survey
+	age := 0.0
+	if !firstSeen.IsZero() {
+		age = min(now.Sub(firstSeen).Hours()/TrustMatureAge.Hours(), 1)
+	}
+	trust *= TrustNewUser + (1-TrustNewUser)*max(age, 0)
+
+	// Activity rate, many surveys in a short time look automated
+	timestamps := []time.Time{}
+	for _, survey := range surveys {
+		if !survey.Timestamp.IsZero() {
+			timestamps = append(timestamps, survey.Timestamp.Time)
+		}
+	}
+	burst := getMaxCountInWindow(timestamps, TrustBurstWindow)
+	if burst > TrustBurstLimit {
+		trust *= float64(TrustBurstLimit) / float64(burst)
+	}
+
+	// Report history
+	trust *= math.Pow(TrustReportPenalty, float64(upheldReports))
+
+	// Answer variance, the same option on every survey looks careless
+	if len(surveys) >= TrustVarianceMinSurveys {
+		trust *= 1 - TrustUniformPenalty*getUniformAnswerRatio(surveys)
+	}
+
+	return min(max(trust, TrustMin), 1)
+}
+
+// Largest number of timestamps within any window of the given duration
+func getMaxCountInWindow(timestamps []time.Time, window time.Duration) int {
+	sorted := append([]time.Time{}, timestamps...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Before(sorted[j]) })
+
+	maxCount := 0
+	start := 0
+	for end := range sorted {
+		for sorted[end].Sub(sorted[start]) > window {
+			start++
+		}
+		maxCount = max(maxCount, end-start+1)
+	}
+	return maxCount
+}
+
+// Ratio of selection questions answered with the same option on every survey
+func getUniformAnswerRatio(surveys []SurveyAnswerDocument) float64 {
+	options := map[string]map[string]int{}
+	answered := map[string]int{}
+	for _, survey := range surveys {
+		for key, answer := range survey.Answers {
+			if answer.Type != "selection" || answer.Option == "" {
+				continue
+			}
+			if options[key] == nil {
+				options[key] = map[string]int{}
+			}
+			options[key][answer.Option]++
+			answered[key]++
+		}
+	}
+
+	checked := 0
+	uniform := 0
+	for key, count := range answered {
+		if count < TrustVarianceMinSurveys {
+			continue
+		}
+		checked++
+		if len(options[key]) == 1 {
+			uniform++
+		}
+	}
+	if checked == 0 {
+		return 0
+	}
+	return float64(uniform) / float64(checked)
+}
+
+// Trust of a new survey: the stored trust of the user, lowered by recent bursts
+// which are not reflected until the next refresh
+func getSubmissionTrust(userCollection *mongo.Collection,
+	surveyCollection *mongo.Collection, userId string) float64 {
+	if userCollection.Name() != UserCollectionName ||
+		surveyCollection.Name() != SurveyCollectionName {
+		log.Println("Wrong collection is assigned")
+		return TrustNewUser
+	}
+
+	trust := TrustNewUser
+	var user UserDocument
+	err := userCollection.FindOne(context.Background(), bson.M{"_id": userId}).Decode(&user)
+	if err == nil && user.Trust > 0 {
+		trust = user.Trust
+	} else if err != nil && err != mongo.ErrNoDocuments {
+		log.Println("Failed to find user " + userId + ": " + err.Error())
+	}
+
+	// Count the surveys in the burst window including the new one
+	recent, err := surveyCollection.CountDocuments(context.Background(), bson.M{
+		"userId":    userId,
+		"timestamp": bson.M{"$gte": time.Now().Add(-TrustBurstWindow)},
+	})
+	if err != nil {
+		log.Println("Failed to count recent surveys of " + userId + ": " + err.Error())
+	} else if recent+1 > TrustBurstLimit {
+		trust *= float64(TrustBurstLimit) / float64(recent+1)
+	}
+	return max(trust, TrustMin)
+}
+
+// Earliest time of the user seen in devices and likes
+func getFirstSeenTime(deviceCollection *mongo.Collection,
+	likeCollection *mongo.Collection, userId string) (time.Time, error) {
+	var firstSeen time.Time
+	var device DeviceDocument
+	err := deviceCollection.FindOne(context.Background(), bson.M{"_id": userId}).Decode(&device)
+	if err == nil {
+		firstSeen = parseTimestamp(device.RegisteredAt)
+	} else if err != mongo.ErrNoDocuments {
+		return firstSeen, err
+	}
+
+	var like LikeDocument
+	err = likeCollection.FindOne(context.Background(), bson.M{"userId": userId},
+		options.FindOne().SetSort(bson.M{"timestamp": 1})).Decode(&like)
+	if err == nil && !like.Timestamp.IsZero() && (firstSeen.IsZero() || like.Timestamp.Before(firstSeen)) {
+		firstSeen = like.Timestamp
+	} else if err != nil && err != mongo.ErrNoDocuments {
+		return firstSeen, err
+	}
+	return firstSeen, nil
+}
+
+// Users whose trust may have changed since the given time: users with new surveys
+// and authors of newly upheld reports
+func getTrustChangedUserIds(surveyCollection *mongo.Collection,
+	reportCollection *mongo.Collection, since time.Time) ([]string, error) {
+	userIds := []string{}
+	found := map[string]bool{}
+	collect := func(collection *mongo.Collection, filter bson.M) error {
+		cursor, err := collection.Aggregate(context.Background(), mongo.Pipeline{
+			{{Key: "$match", Value: filter}},
+			{{Key: "$group", Value: bson.M{"_id": "$userId"}}},
+		}, options.Aggregate().SetAllowDiskUse(true))
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(context.Background())
+		for cursor.Next(context.Background()) {
+			var result struct {
+				UserId string `bson:"_id"`
+			}
+			if err := cursor.Decode(&result); err != nil {
+				log.Println("User cursor decode error: " + err.Error())
+				continue
+			}
+			if result.UserId != "" && !found[result.UserId] {
+				found[result.UserId] = true
+				userIds = append(userIds, result.UserId)
+			}
+		}
+		return cursor.Err()
+	}
+
+	// All users on the first refresh
+	surveyFilter := bson.M{}
+	reportFilter := bson.M{"state": "upheld"}
+	if !since.IsZero() {
+		surveyFilter["timestamp"] = bson.M{"$gt": since}
+		reportFilter["resolvedTimestamp"] = bson.M{"$gt": since.Format(TimestampFormat)}
+	}
+	if err := collect(surveyCollection, surveyFilter); err != nil {
+		return nil, err
+	}
+	if err := collect(reportCollection, reportFilter); err != nil {
+		return nil, err
+	}
+	return userIds, nil
+}
+
+// Set the trust to the surveys of the user, and apply the weight difference to the summaries.
+// Surveys are read again in the transaction, so that concurrent submissions are not overwritten.
+func applySurveyTrust(ctx context.Context, surveyCollection *mongo.Collection,
+	summaryCollection *mongo.Collection, userId string, trust float64) error {
+	cursor, err := surveyCollection.Find(ctx, bson.M{"userId": userId})
+	if err != nil {
+		return err
+	}
+	var surveys []SurveyAnswerDocument
+	if err = cursor.All(ctx, &surveys); err != nil {
+		return err
+	}
+
+	for _, survey := range surveys {
+		if math.Abs(survey.getTrust()-trust) <= SurveyWeightTolerance {
+			continue
+		}
+		_, err = surveyCollection.UpdateOne(ctx, bson.M{"hospitalId": survey.HospitalId, "userId": userId},
+			bson.M{"$set": bson.M{"trust": trust}})
+		if err != nil {
+			return err
+		}
+
+		// Hidden surveys are not counted in summaries
+		if survey.Hidden {
+			continue
+		}
+		current := survey
+		current.Trust = trust
+		if !updateSurveySummary(ctx, summaryCollection, survey.HospitalId, &survey, &current) {
+			return fmt.Errorf("failed to update survey summary of %s", survey.HospitalId)
+		}
+	}
+	return nil
+}
+
+// Recompute the trust of users with surveys or upheld reports since the last refresh,
+// store it on users and their surveys, and apply the weight differences to summaries.
+// Users who submitted in the mature age are included too, as their age factor still grows.
+func refreshTrustScores(userCollection *mongo.Collection,
+	surveyCollection *mongo.Collection,
+	summaryCollection *mongo.Collection,
+	likeCollection *mongo.Collection,
+	reportCollection *mongo.Collection,
+	deviceCollection *mongo.Collection,
+	settingCollection *mongo.Collection) (int, error) {
+	if userCollection.Name() != UserCollectionName ||
+		surveyCollection.Name() != SurveyCollectionName ||
+		summaryCollection.Name() != SurveySummaryCollectionName ||
+		likeCollection.Name() != LikeCollectionName ||
+		reportCollection.Name() != SurveyReportCollectionName ||
+		deviceCollection.Name() != DeviceCollectionName ||
+		settingCollection.Name() != SettingCollectionName {
+		return 0, fmt.Errorf("wrong collection is assigned")
+	}
+
+	var setting TrustRefreshDocument
+	err := settingCollection.FindOne(context.Background(),
+		bson.M{"_id": SettingKeyTrustRefresh}).Decode(&setting)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return 0, err
+	}
+
+	now := time.Now()
+	since := setting.LastRun
+	if maturing := now.Add(-TrustMatureAge - TrustRefreshInterval); !since.IsZero() && maturing.Before(since) {
+		since = maturing
+	}
+	userIds, err := getTrustChangedUserIds(surveyCollection, reportCollection, since)
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := now.Format(TimestampFormat)
+	client := surveyCollection.Database().Client()
+	changed := 0
+	for _, userId := range userIds {
+		cursor, err := surveyCollection.Find(context.Background(), bson.M{"userId": userId})
+		if err != nil {
+			return 0, err
+		}
+		var surveys []SurveyAnswerDocument
+		if err = cursor.All(context.Background(), &surveys); err != nil {
+			return 0, err
+		}
+		seen, err := getFirstSeenTime(deviceCollection, likeCollection, userId)
+		if err != nil {
+			return 0, err
+		}
+		upheldReports, err := reportCollection.CountDocuments(context.Background(),
+			bson.M{"userId": userId, "state": "upheld"})
+		if err != nil {
+			return 0, err
+		}
+
+		for _, survey := range surveys {
+			if !survey.Timestamp.IsZero() && (seen.IsZero() || survey.Timestamp.Before(seen)) {
+				seen = survey.Timestamp.Time
+			}
+		}
+		trust := computeTrust(seen, surveys, int(upheldReports), now)
+		stale := false
+		for _, survey := range surveys {
+			stale = stale || math.Abs(survey.getTrust()-trust) > SurveyWeightTolerance
+		}
+
+		_, err = userCollection.UpdateOne(context.Background(), bson.M{"_id": userId},
+			bson.M{"$set": bson.M{"trust": trust, "trustUpdate": timestamp}},
+			options.Update().SetUpsert(true))
+		if err != nil {
+			return 0, err
+		}
+		if stale {
+			err = runInTransaction(client, func(ctx context.Context) error {
+				return applySurveyTrust(ctx, surveyCollection, summaryCollection, userId, trust)
+			})
+			if err != nil {
+				return 0, fmt.Errorf("failed to apply trust of %s: %w", userId, err)
+			}
+			changed++
+		}
+	}
+	if changed > 0 {
+		log.Printf("Applied new trust scores to surveys of %d users", changed)
+	}
+
+	// Save the start time, so that surveys submitted during the refresh are checked next time
+	_, err = settingCollection.UpdateOne(context.Background(), bson.M{"_id": SettingKeyTrustRefresh},
+		bson.M{"$set": bson.M{"lastRun": now}}, options.Update().SetUpsert(true))
+	if err != nil {
+		return 0, err
+	}
+	return len(userIds), nil
+}
+
+func startTrustRefresher(userCollection *mongo.Collection,
+	surveyCollection *mongo.Collection,
+	summaryCollection *mongo.Collection,
+	likeCollection *mongo.Collection,
+	reportCollection *mongo.Collection,
+	deviceCollection *mongo.Collection,
+	settingCollection *mongo.Collection) {
+	refresh := func() {
+		count, err := refreshTrustScores(userCollection, surveyCollection, summaryCollection,
+			likeCollection, reportCollection, deviceCollection, settingCollection)
+		if err != nil {
+			log.Println("Failed to refresh trust scores: " + err.Error())
+			return
+		}
+		log.Printf("Refreshed trust scores of %d users", count)
+	}
+
+	// The first refresh reads all surveys, so don't block the server start
+	go func() {
+		refresh()
+		for range time.Tick(TrustRefreshInterval) {
+			refresh()
+		}
+	}()
+}
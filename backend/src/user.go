@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
-	"strconv"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -14,15 +13,30 @@ import (
 
 type UserDocument struct {
 	UserId  string   `bson:"_id"`
-	Likes   []string `bson:"likes"`   // Hospital ids that the user liked
 	Surveys []string `bson:"surveys"` // Hospital ids that the user submitted survey
+
+	// Reliability of surveys of the user (0 ~ 1), refreshed by the trust refresher
+	Trust       float64 `bson:"trust,omitempty"`
+	TrustUpdate string  `bson:"trustUpdate,omitempty"`
 }
 
 type SurveyCountResponse struct {
 	Count int `json:"count"`
 }
 
-func recordUserLike(collection *mongo.Collection, userId string, hospitalId string, like bool) bool {
+type UserDataDeleteResponse struct {
+	DeletedSurveys    int   `json:"deletedSurveys"`
+	DeletedLikes      int64 `json:"deletedLikes"`
+	DeletedTips       int64 `json:"deletedTips"`
+	DeletedVotes      int64 `json:"deletedVotes"`
+	DeletedWaiting    int64 `json:"deletedWaiting"`
+	DeletedActivities int64 `json:"deletedActivities"`
+	DeletedLists      int64 `json:"deletedLists"`
+	DeletedReports    int64 `json:"deletedReports"`    // Open reports filed by the user
+	AnonymizedReports int64 `json:"anonymizedReports"` // Resolved reports filed by the user
+}
+
+func recordUserSurvey(ctx context.Context, collection *mongo.Collection, userId string, hospitalId string) bool {
 	if collection.Name() != UserCollectionName {
 		log.Printf("Got wrong collection: %s", collection.Name())
 		return false
@@ -30,52 +44,208 @@ func recordUserLike(collection *mongo.Collection, userId string, hospitalId stri
 
 	// Define the filter
 	filter := bson.M{"_id": userId}
-	update := bson.M{}
-	opts := options.UpdateOptions{}
-
-	if like {
-		// Like
-		update = bson.M{"$addToSet": bson.M{"likes": hospitalId}}
-		// Create document if it doesn't exist
-		opts = *options.Update().SetUpsert(true)
-	} else {
-		// Unlike
-		update = bson.M{"$pull": bson.M{"likes": hospitalId}}
-	}
+	update := bson.M{"$addToSet": bson.M{"surveys": hospitalId}}
+	// Create document if it doesn't exist
+	opts := *options.Update().SetUpsert(true)
 
-	_, err := collection.UpdateOne(context.Background(), filter, update, &opts)
+	_, err := collection.UpdateOne(ctx, filter, update, &opts)
 	if err != nil {
-		log.Println("Failed to record like " + strconv.FormatBool(like) +
-			" of " + hospitalId + " to user " + userId + ": " +
-			err.Error())
+		log.Println("Failed to record survey of " + hospitalId +
+			" to user " + userId + ": " + err.Error())
 		return false
 	}
 
 	return true
 }
 
-func recordUserSurvey(collection *mongo.Collection, userId string, hospitalId string) bool {
+func removeUserSurvey(ctx context.Context, collection *mongo.Collection, userId string, hospitalId string) bool {
 	if collection.Name() != UserCollectionName {
 		log.Printf("Got wrong collection: %s", collection.Name())
 		return false
 	}
 
-	// Define the filter
-	filter := bson.M{"_id": userId}
-	update := bson.M{"$addToSet": bson.M{"surveys": hospitalId}}
-	// Create document if it doesn't exist
-	opts := *options.Update().SetUpsert(true)
-
-	_, err := collection.UpdateOne(context.Background(), filter, update, &opts)
+	update := bson.M{"$pull": bson.M{"surveys": hospitalId}}
+	_, err := collection.UpdateOne(ctx, bson.M{"_id": userId}, update)
 	if err != nil {
-		log.Println("Failed to record survey of " + hospitalId +
-			" to user " + userId + ": " + err.Error())
+		log.Println("Failed to remove survey of " + hospitalId +
+			" from user " + userId + ": " + err.Error())
 		return false
 	}
 
 	return true
 }
 
+// Remove all surveys, tips and likes of the user, and the user document itself.
+// Surveys are found from the survey collection instead of the user document,
+// so that surveys missing in the user document are removed as well.
+func handleDeleteUserData(surveyCollection *mongo.Collection,
+	likeCollection *mongo.Collection,
+	likeCountCollection *mongo.Collection,
+	userCollection *mongo.Collection,
+	tipCollection *mongo.Collection,
+	summaryCollection *mongo.Collection,
+	voteCollection *mongo.Collection,
+	waitingCollection *mongo.Collection,
+	activityCollection *mongo.Collection,
+	listCollection *mongo.Collection,
+	reportCollection *mongo.Collection,
+	deviceCollection *mongo.Collection,
+	transferCodeCollection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Only DELETE method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if surveyCollection.Name() != SurveyCollectionName ||
+			likeCollection.Name() != LikeCollectionName ||
+			likeCountCollection.Name() != LikeCountCollectionName ||
+			userCollection.Name() != UserCollectionName ||
+			tipCollection.Name() != SurveyTipCollectionName ||
+			summaryCollection.Name() != SurveySummaryCollectionName ||
+			voteCollection.Name() != SurveyVoteCollectionName ||
+			waitingCollection.Name() != WaitingReportCollectionName ||
+			activityCollection.Name() != ActivityEventCollectionName ||
+			listCollection.Name() != FavoriteListCollectionName ||
+			reportCollection.Name() != SurveyReportCollectionName ||
+			deviceCollection.Name() != DeviceCollectionName ||
+			transferCodeCollection.Name() != TransferCodeCollectionName {
+			log.Println("Wrong collection is assigned")
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+
+		userId := r.URL.Query().Get("userId")
+		if userId == "" {
+			http.Error(w, "userId is empty", http.StatusBadRequest)
+			return
+		}
+
+		// Find hospitals of the surveys
+		hospitalIds, err := surveyCollection.Distinct(context.Background(), "hospitalId", bson.M{"userId": userId})
+		if err != nil {
+			http.Error(w, "Error while finding surveys", http.StatusInternalServerError)
+			log.Println("Failed to find surveys of " + userId + ": " + err.Error())
+			return
+		}
+
+		response := UserDataDeleteResponse{}
+		for _, value := range hospitalIds {
+			hospitalId, ok := value.(string)
+			if !ok {
+				continue
+			}
+			found := false
+			err := runInTransaction(surveyCollection.Database().Client(), func(ctx context.Context) error {
+				var err error
+				found, err = deleteSurveyAnswer(ctx, surveyCollection, tipCollection, summaryCollection, hospitalId, userId)
+				return err
+			})
+			if err != nil {
+				http.Error(w, "Error while deleting surveys", http.StatusInternalServerError)
+				log.Println("Failed to delete survey answer of " + hospitalId + " for " + userId + ": " + err.Error())
+				return
+			}
+			if found {
+				response.DeletedSurveys++
+			}
+		}
+
+		// Tips of removed questions are not deleted with surveys
+		response.DeletedTips, err = deleteUserSurveyTips(context.Background(), tipCollection, userId, "")
+		if err != nil {
+			http.Error(w, "Error while deleting survey tips", http.StatusInternalServerError)
+			log.Println("Failed to delete survey tips of " + userId + ": " + err.Error())
+			return
+		}
+
+		response.DeletedLikes, err = removeAllLikes(likeCollection, likeCountCollection, userId)
+		if err != nil {
+			http.Error(w, "Error while deleting likes", http.StatusInternalServerError)
+			log.Println("Failed to delete likes of " + userId + ": " + err.Error())
+			return
+		}
+
+		response.DeletedVotes, err = removeAllSurveyVotes(voteCollection, tipCollection, userId)
+		if err != nil {
+			http.Error(w, "Error while deleting survey votes", http.StatusInternalServerError)
+			log.Println("Failed to delete survey votes of " + userId + ": " + err.Error())
+			return
+		}
+
+		result, err := waitingCollection.DeleteMany(context.Background(), bson.M{"userId": userId})
+		if err != nil {
+			http.Error(w, "Error while deleting waiting reports", http.StatusInternalServerError)
+			log.Println("Failed to delete waiting reports of " + userId + ": " + err.Error())
+			return
+		}
+		response.DeletedWaiting = result.DeletedCount
+
+		result, err = activityCollection.DeleteMany(context.Background(), bson.M{"userId": userId})
+		if err != nil {
+			http.Error(w, "Error while deleting activity events", http.StatusInternalServerError)
+			log.Println("Failed to delete activity events of " + userId + ": " + err.Error())
+			return
+		}
+		response.DeletedActivities = result.DeletedCount
+
+		result, err = listCollection.DeleteMany(context.Background(), bson.M{"userId": userId})
+		if err != nil {
+			http.Error(w, "Error while deleting favorite lists", http.StatusInternalServerError)
+			log.Println("Failed to delete favorite lists of " + userId + ": " + err.Error())
+			return
+		}
+		response.DeletedLists = result.DeletedCount
+
+		// Open reports are withdrawn. Resolved reports are kept for the moderation history
+		// and the trust of the authors, with the reporter replaced by a unique placeholder.
+		result, err = reportCollection.DeleteMany(context.Background(),
+			bson.M{"reporterId": userId, "state": "open"})
+		if err != nil {
+			http.Error(w, "Error while deleting survey reports", http.StatusInternalServerError)
+			log.Println("Failed to delete survey reports of " + userId + ": " + err.Error())
+			return
+		}
+		response.DeletedReports = result.DeletedCount
+
+		updateResult, err := reportCollection.UpdateMany(context.Background(), bson.M{"reporterId": userId},
+			mongo.Pipeline{{{Key: "$set", Value: bson.M{
+				"reporterId": bson.M{"$concat": bson.A{"deleted:", bson.M{"$toString": "$_id"}}},
+			}}}})
+		if err != nil {
+			http.Error(w, "Error while anonymizing survey reports", http.StatusInternalServerError)
+			log.Println("Failed to anonymize survey reports of " + userId + ": " + err.Error())
+			return
+		}
+		response.AnonymizedReports = updateResult.ModifiedCount
+
+		_, err = transferCodeCollection.DeleteMany(context.Background(), bson.M{"userId": userId})
+		if err != nil {
+			http.Error(w, "Error while deleting transfer codes", http.StatusInternalServerError)
+			log.Println("Failed to delete transfer codes of " + userId + ": " + err.Error())
+			return
+		}
+
+		_, err = deviceCollection.DeleteOne(context.Background(), bson.M{"_id": userId})
+		if err != nil {
+			http.Error(w, "Error while deleting device", http.StatusInternalServerError)
+			log.Println("Failed to delete device of " + userId + ": " + err.Error())
+			return
+		}
+
+		// Remove the user document at last, so that a failed request can be retried
+		_, err = userCollection.DeleteOne(context.Background(), bson.M{"_id": userId})
+		if err != nil {
+			http.Error(w, "Error while deleting user", http.StatusInternalServerError)
+			log.Println("Failed to delete user " + userId + ": " + err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
 func handleGetUserSurveyCount(collection *mongo.Collection) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type FieldErrorListResponse struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func writeFieldErrors(w http.ResponseWriter, errors []FieldError) {
+	response := FieldErrorListResponse{
+		Errors: errors,
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Waiting time reported by a visitor, expired by the TTL index
+type WaitingReportDocument struct {
+	Id         primitive.ObjectID `bson:"_id,omitempty"`
+	HospitalId string             `bson:"hospitalId"`
+	UserId     string             `bson:"userId"`
+	Minutes    string             `bson:"minutes"` // One of WaitingBuckets
+	Timestamp  time.Time          `bson:"timestamp"`
+}
+
+type WaitingReportPostRequest struct {
+	HospitalId string `json:"hospitalId"`
+	UserId     string `json:"userId"`
+	Minutes    string `json:"minutes"` // "below15min", "below30min", "below60min", "over60min"
+}
+
+type WaitingEstimate struct {
+	Minutes     float64 `json:"minutes"`     // Weighted average of representative minutes of buckets
+	Bucket      string  `json:"bucket"`      // Bucket of the estimated minutes
+	ReportCount int     `json:"reportCount"` // Reports in the window
+	LastReport  string  `json:"lastReport"`
+}
+
+type WaitingBucket struct {
+	Key        string
+	MaxMinutes float64 // Upper bound of the bucket
+	Minutes    float64 // Representative minutes of the bucket
+}
+
+// Same options as the retired waiting questions of surveys
+var WaitingBuckets = []WaitingBucket{
+	{Key: "below15min", MaxMinutes: 15, Minutes: 7.5},
+	{Key: "below30min", MaxMinutes: 30, Minutes: 22.5},
+	{Key: "below60min", MaxMinutes: 60, Minutes: 45},
+	{Key: "over60min", MaxMinutes: math.Inf(1), Minutes: 75},
+}
+
+func getWaitingBucket(key string) (WaitingBucket, bool) {
+	for _, bucket := range WaitingBuckets {
+		if bucket.Key == key {
+			return bucket, true
+		}
+	}
+	return WaitingBucket{}, false
+}
+
+func getWaitingBucketKeys() []string {
+	keys := []string{}
+	for _, bucket := range WaitingBuckets {
+		keys = append(keys, bucket.Key)
+	}
+	return keys
+}
+
+func ensureWaitingReportCollectionIndex(collection *mongo.Collection) bool {
+	if collection.Name() != WaitingReportCollectionName {
+		log.Printf("Got wrong collection: %s", collection.Name())
+		return false
+	}
+
+	indexModels := []mongo.IndexModel{
+		// Finding recent reports of a hospital
+		{
+			Keys: bson.D{
+				{Key: "hospitalId", Value: 1}, // 1 for ascending order
+				{Key: "timestamp", Value: -1}, // -1 for descending order
+			},
+		},
+		// Expire old reports
+		{
+			Keys: bson.D{
+				{Key: "timestamp", Value: 1},
+			},
+			Options: options.Index().SetExpireAfterSeconds(int32(WaitingReportTtl.Seconds())),
+		},
+	}
+
+	_, err := collection.Indexes().CreateMany(context.Background(), indexModels)
+	if err != nil {
+		log.Println("Could not create index in waiting report collection: " + err.Error())
+		return false
+	}
+	log.Println("Waiting report collection index created successfully")
+	return true
+}
+
+// Estimate the current waiting time from reports in the window.
+// Recent reports weigh more, halving every WaitingReportHalfLife.
+// Returns nil if there are no reports.
+func getCurrentWaiting(collection *mongo.Collection, hospitalId string) *WaitingEstimate {
+	if collection.Name() != WaitingReportCollectionName {
+		log.Printf("Got wrong collection: %s", collection.Name())
+		return nil
+	}
+
+	now := time.Now()
+	filter := bson.M{"hospitalId": hospitalId, "timestamp": bson.M{"$gte": now.Add(-WaitingReportWindow)}}
+	cursor, err := collection.Find(context.Background(), filter)
+	if err != nil {
+		log.Println("Error while finding waiting reports of " + hospitalId + ": " + err.Error())
+		return nil
+	}
+	defer cursor.Close(context.Background())
+
+	var documents []WaitingReportDocument
+	if err = cursor.All(context.Background(), &documents); err != nil {
+		log.Println("Error while decoding waiting reports of " + hospitalId + ": " + err.Error())
+		return nil
+	}
+	if len(documents) == 0 {
+		return nil
+	}
+
+	var weightSum, minuteSum float64
+	var lastReport time.Time
+	for _, document := range documents {
+		bucket, ok := getWaitingBucket(document.Minutes)
+		if !ok {
+			continue
+		}
+		age := now.Sub(document.Timestamp)
+		weight := math.Pow(0.5, age.Minutes()/WaitingReportHalfLife.Minutes())
+		weightSum += weight
+		minuteSum += weight * bucket.Minutes
+		if document.Timestamp.After(lastReport) {
+			lastReport = document.Timestamp
+		}
+	}
+	if weightSum == 0 {
+		return nil
+	}
+
+	estimate := WaitingEstimate{
+		Minutes:     minuteSum / weightSum,
+		ReportCount: len(documents),
+		LastReport:  lastReport.Local().Format(TimestampFormat),
+	}
+	for _, bucket := range WaitingBuckets {
+		if estimate.Minutes < bucket.MaxMinutes {
+			estimate.Bucket = bucket.Key
+			break
+		}
+	}
+	return &estimate
+}
+
+func handlePostWaitingReport(waitingCollection *mongo.Collection,
+	hospitalCollection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if waitingCollection.Name() != WaitingReportCollectionName ||
+			hospitalCollection.Name() != HospitalCollectionName {
+			log.Println("Wrong collection is assigned")
+			http.Error(w, "Wrong collection is assigned", http.StatusInternalServerError)
+			return
+		}
+
+		var request WaitingReportPostRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Println("Failed to decode waiting report post request: " + err.Error())
+			return
+		}
+
+		fieldErrors := []FieldError{}
+		if request.UserId == "" {
+			fieldErrors = append(fieldErrors, FieldError{Field: "userId", Message: "userId is empty"})
+		}
+		if _, ok := getWaitingBucket(request.Minutes); !ok {
+			fieldErrors = append(fieldErrors, FieldError{Field: "minutes",
+				Message: fmt.Sprintf("minutes should be one of %v", getWaitingBucketKeys())})
+		}
+		found, err := checkHospitalExists(hospitalCollection, request.HospitalId)
+		if err != nil {
+			http.Error(w, "Error while finding hospital", http.StatusInternalServerError)
+			log.Println("Failed to find hospital " + request.HospitalId + ": " + err.Error())
+			return
+		}
+		if !found {
+			fieldErrors = append(fieldErrors, FieldError{Field: "hospitalId", Message: "hospital does not exist"})
+		}
+		if len(fieldErrors) > 0 {
+			writeFieldErrors(w, fieldErrors)
+			return
+		}
+
+		// A recent report of the user is replaced, so that a user can not flood the estimate
+		now := time.Now()
+		filter := bson.M{
+			"hospitalId": request.HospitalId,
+			"userId":     request.UserId,
+			"timestamp":  bson.M{"$gte": now.Add(-WaitingReportInterval)},
+		}
+		update := bson.M{"$set": bson.M{"minutes": request.Minutes, "timestamp": now}}
+		result, err := waitingCollection.UpdateOne(context.Background(), filter, update)
+		if err == nil && result.MatchedCount == 0 {
+			_, err = waitingCollection.InsertOne(context.Background(), WaitingReportDocument{
+				HospitalId: request.HospitalId,
+				UserId:     request.UserId,
+				Minutes:    request.Minutes,
+				Timestamp:  now,
+			})
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Println("Failed to save waiting report: " + err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(getCurrentWaiting(waitingCollection, request.HospitalId))
+	}
+}